@@ -4,9 +4,13 @@ package godrive
 //
 // (C) 2015 by Marco Paganini <paganini@paganini.net>
 
-import "time"
+import (
+	"strings"
+	"time"
+)
 
 const (
+	// Default cache TTL (see SetCacheTTL)
 	cacheTTLSeconds = 60
 )
 
@@ -14,22 +18,28 @@ const (
 type objCache struct {
 	obj       interface{}
 	timestamp time.Time
+
+	// Last time this object was checked against Google Drive
+	validated time.Time
 }
 
 // Add/replace object in the cache using 'drivePath' as a key.
 func cacheAdd(cache *map[string]*objCache, drivePath string, obj interface{}) {
-	item := &objCache{obj, time.Now()}
+	now := time.Now()
+	item := &objCache{obj, now, now}
 	m := *cache
 	m[drivePath] = item
 }
 
-// Retrieve object from the cache using 'drivePath' as a key.
+// Retrieve object from the cache using 'drivePath' as a key. Objects older
+// than 'ttl' are considered expired. A zero ttl means objects never expire and
+// a negative ttl disables the cache (nothing is ever returned.)
 // Returns an *interface{} object or nil if not found or expired.
-func cacheGet(cache *map[string]*objCache, drivePath string) interface{} {
+func cacheGet(cache *map[string]*objCache, drivePath string, ttl time.Duration) interface{} {
 	m := *cache
 	item, ok := m[drivePath]
 	if ok {
-		if time.Now().After(item.timestamp.Add(cacheTTLSeconds * time.Second)) {
+		if ttl < 0 || (ttl > 0 && time.Now().After(item.timestamp.Add(ttl))) {
 			cacheDel(cache, drivePath)
 			return nil
 		}
@@ -39,7 +49,48 @@ func cacheGet(cache *map[string]*objCache, drivePath string) interface{} {
 	return nil
 }
 
+// Returns true if the object under 'drivePath' was last validated more than
+// 'interval' ago. Objects not in the cache never need validation.
+func cacheNeedsValidation(cache *map[string]*objCache, drivePath string, interval time.Duration) bool {
+	item, ok := (*cache)[drivePath]
+	return ok && time.Now().After(item.validated.Add(interval))
+}
+
+// Mark the object under 'drivePath' as validated now.
+func cacheSetValidated(cache *map[string]*objCache, drivePath string) {
+	if item, ok := (*cache)[drivePath]; ok {
+		item.validated = time.Now()
+	}
+}
+
 // Remove object from the cache using 'drivePath' as a key.
 func cacheDel(cache *map[string]*objCache, drivePath string) {
 	delete(*cache, drivePath)
 }
+
+// Remove 'drivePath' and every object below it from the cache. Cached paths
+// may or may not start with a slash, so keys are compared without it.
+// Returns the removed objects.
+func cacheDelPrefix(cache *map[string]*objCache, drivePath string) []interface{} {
+	var ret []interface{}
+	prefix := strings.TrimPrefix(drivePath, "/")
+	for key, item := range *cache {
+		k := strings.TrimPrefix(key, "/")
+		if k == prefix || strings.HasPrefix(k, prefix+"/") {
+			ret = append(ret, item.obj)
+			delete(*cache, key)
+		}
+	}
+	return ret
+}
+
+// Return the keys of all objects in the cache for which 'match' returns true.
+func cacheKeys(cache *map[string]*objCache, match func(obj interface{}) bool) []string {
+	var ret []string
+	for key, item := range *cache {
+		if match(item.obj) {
+			ret = append(ret, key)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package godrive
+
+// Free disk space detection for systems without statfs
+//
+// This file is part of the godrive library
+//
+// (C) 2015 by Marco Paganini <paganini@paganini.net>
+
+// diskFree returns -1 (unknown) on systems without statfs, which disables
+// the free space check.
+func diskFree(dir string) (int64, error) {
+	return -1, nil
+}
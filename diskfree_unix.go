@@ -0,0 +1,24 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package godrive
+
+// Free disk space detection for Unix systems
+//
+// This file is part of the godrive library
+//
+// (C) 2015 by Marco Paganini <paganini@paganini.net>
+
+import (
+	"syscall"
+)
+
+// diskFree returns the number of bytes available to unprivileged users in
+// the filesystem containing 'dir'.
+func diskFree(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(uint64(st.Bavail) * uint64(st.Bsize)), nil
+}
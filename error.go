@@ -6,6 +6,13 @@ package godrive
 //
 // (C) 2015 by Marco Paganini <paganini@paganini.net>
 
+import (
+	"errors"
+	"strings"
+
+	"google.golang.org/api/googleapi"
+)
+
 // Error defines a custom error for godrive
 type Error struct {
 	ObjectNotFound bool
@@ -16,11 +23,78 @@ func (e *Error) Error() string {
 	return e.msg
 }
 
-// IsObjectNotFound Returns true if the passed error is of type godrive.Error
-// and the error condition was caused by an Object Not Found.
+// APIError is returned when Google Drive answers a request with an error. It
+// holds the HTTP status code and the reason given by Google Drive (e.g.
+// "notFound", "rateLimitExceeded"), and wraps the original *googleapi.Error.
+type APIError struct {
+	Code   int
+	Reason string
+	err    *googleapi.Error
+}
+
+func (e *APIError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the original *googleapi.Error.
+func (e *APIError) Unwrap() error {
+	return e.err
+}
+
+// newAPIError returns 'err' as an *APIError if it is a *googleapi.Error, or
+// unchanged otherwise.
+func newAPIError(err error) error {
+	derr, ok := err.(*googleapi.Error)
+	if !ok {
+		return err
+	}
+	ret := &APIError{Code: derr.Code, err: derr}
+	if len(derr.Errors) > 0 {
+		ret.Reason = derr.Errors[0].Reason
+	}
+	return ret
+}
+
+// IsRateLimited returns true if 'e' (or any error it wraps) is an *APIError
+// caused by Google Drive rate limiting the requests (HTTP 429, or 403 with a
+// rate limit reason.)
+func IsRateLimited(e error) bool {
+	var aerr *APIError
+	if !errors.As(e, &aerr) {
+		return false
+	}
+	if aerr.Code == 429 {
+		return true
+	}
+	return aerr.Code == 403 && (aerr.Reason == "rateLimitExceeded" || aerr.Reason == "userRateLimitExceeded")
+}
+
+// IsPermissionDenied returns true if 'e' (or any error it wraps) is an
+// *APIError caused by the user lacking permission to perform the operation
+// (HTTP 403 for reasons other than rate limiting or transient backend errors.)
+func IsPermissionDenied(e error) bool {
+	var aerr *APIError
+	return errors.As(e, &aerr) && aerr.Code == 403 && aerr.Reason != "backendError" && !IsRateLimited(e)
+}
+
+// MultiError holds the individual errors from an operation acting on
+// multiple objects, where the failure of one object does not stop the others.
+type MultiError []error
+
+func (m MultiError) Error() string {
+	msgs := make([]string, len(m))
+	for idx, err := range m {
+		msgs[idx] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// IsObjectNotFound Returns true if the passed error (or any error it wraps) is
+// of type godrive.Error and the error condition was caused by an Object Not
+// Found.
 func IsObjectNotFound(e error) bool {
-	serr, ok := e.(*Error)
-	if ok && serr.ObjectNotFound {
+	var serr *Error
+	if errors.As(e, &serr) && serr.ObjectNotFound {
 		return true
 	}
 	return false
@@ -0,0 +1,204 @@
+package godrive
+
+// io/fs interoperability for godrive
+//
+// This file is part of the godrive library
+//
+// (C) 2015 by Marco Paganini <paganini@paganini.net>
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"time"
+
+	drive "google.golang.org/api/drive/v2"
+)
+
+// FS is a read-only view of Google Drive implementing fs.FS, fs.ReadDirFS
+// and fs.StatFS. Names follow the io/fs conventions (slash separated, no
+// leading slash, "." is the root of the drive).
+type FS struct {
+	g *Gdrive
+}
+
+// NewFS returns a new *FS backed by the *Gdrive object 'g'.
+func NewFS(g *Gdrive) *FS {
+	return &FS{g: g}
+}
+
+// Open opens the named file or directory. Files are opened for reading with
+// Download, so native Google Docs (which have no body) cannot be opened.
+func (f *FS) Open(name string) (fs.File, error) {
+	drivePath, err := f.drivePath("open", name)
+	if err != nil {
+		return nil, err
+	}
+	driveFile, err := f.g.Stat(drivePath)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	if IsDir(driveFile) {
+		return &fsDir{fs: f, name: name, info: &fileInfo{driveFile}}, nil
+	}
+	body, err := f.g.Download(drivePath)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	return &fsFile{info: &fileInfo{driveFile}, body: body}, nil
+}
+
+// ReadDir reads the named directory and returns its entries sorted by name.
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	drivePath, err := f.drivePath("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	files, err := f.g.ListDir(drivePath, "")
+	if err != nil {
+		return nil, pathError("readdir", name, err)
+	}
+	entries := make([]fs.DirEntry, len(files))
+	for idx, driveFile := range files {
+		entries[idx] = dirEntry{&fileInfo{driveFile}}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// Stat returns a fs.FileInfo describing the named file or directory.
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	drivePath, err := f.drivePath("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	driveFile, err := f.g.Stat(drivePath)
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	return &fileInfo{driveFile}, nil
+}
+
+// drivePath validates an io/fs name and converts it to a godrive path.
+func (f *FS) drivePath(op string, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return "/", nil
+	}
+	return name, nil
+}
+
+// pathError converts a godrive error into a *fs.PathError, mapping
+// ObjectNotFound errors to fs.ErrNotExist.
+func pathError(op string, name string, err error) error {
+	if IsObjectNotFound(err) {
+		err = fs.ErrNotExist
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// fsFile is an open (regular) file, as returned by FS.Open.
+type fsFile struct {
+	info *fileInfo
+	body io.ReadCloser
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *fsFile) Read(b []byte) (int, error) { return f.body.Read(b) }
+func (f *fsFile) Close() error               { return f.body.Close() }
+
+// fsDir is an open directory, as returned by FS.Open. Entries are fetched on
+// the first call to ReadDir.
+type fsDir struct {
+	fs      *FS
+	name    string
+	info    *fileInfo
+	entries []fs.DirEntry
+	offset  int
+	read    bool
+}
+
+func (d *fsDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *fsDir) Close() error               { return nil }
+
+func (d *fsDir) Read(b []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+// ReadDir returns the next 'n' entries in the directory, following the
+// semantics of fs.ReadDirFile.
+func (d *fsDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		entries, err := d.fs.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries = entries
+		d.read = true
+	}
+
+	remaining := len(d.entries) - d.offset
+	if n <= 0 {
+		ret := d.entries[d.offset:]
+		d.offset = len(d.entries)
+		return ret, nil
+	}
+	if remaining == 0 {
+		return nil, io.EOF
+	}
+	if n > remaining {
+		n = remaining
+	}
+	ret := d.entries[d.offset : d.offset+n]
+	d.offset += n
+	return ret, nil
+}
+
+// fileInfo implements fs.FileInfo (and os.FileInfo) over a *drive.File.
+type fileInfo struct {
+	driveFile *drive.File
+}
+
+func (fi *fileInfo) Name() string       { return fi.driveFile.Title }
+func (fi *fileInfo) Size() int64        { return fi.driveFile.FileSize }
+func (fi *fileInfo) IsDir() bool        { return IsDir(fi.driveFile) }
+func (fi *fileInfo) Sys() interface{}   { return fi.driveFile }
+func (fi *fileInfo) Mode() os.FileMode  { return fileMode(fi.driveFile) }
+func (fi *fileInfo) ModTime() time.Time { return modTime(fi.driveFile) }
+
+// dirEntry implements fs.DirEntry over a *fileInfo.
+type dirEntry struct {
+	info *fileInfo
+}
+
+func (de dirEntry) Name() string               { return de.info.Name() }
+func (de dirEntry) IsDir() bool                { return de.info.IsDir() }
+func (de dirEntry) Type() fs.FileMode          { return de.info.Mode().Type() }
+func (de dirEntry) Info() (fs.FileInfo, error) { return de.info, nil }
+
+// fileMode returns the os.FileMode equivalent of a *drive.File. Folders get
+// os.ModeDir, and the write bit is only set for objects editable by the user.
+func fileMode(driveFile *drive.File) os.FileMode {
+	mode := os.FileMode(0444)
+	if driveFile.Editable {
+		mode |= 0200
+	}
+	if IsDir(driveFile) {
+		mode |= os.ModeDir | 0111
+	}
+	return mode
+}
+
+// modTime returns the modification time of a *drive.File, or the zero time
+// if the date cannot be parsed.
+func modTime(driveFile *drive.File) time.Time {
+	t, err := ModifiedDate(driveFile)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
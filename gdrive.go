@@ -11,28 +11,51 @@ package godrive
 // (C) 2015 by Marco Paganini <paganini@paganini.net>
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/marcopaganini/logger"
+	"golang.org/x/oauth2/google"
+	"golang.org/x/time/rate"
 
 	oauth "code.google.com/p/goauth2/oauth"
-	drive "code.google.com/p/google-api-go-client/drive/v2"
+	drive "google.golang.org/api/drive/v2"
+	"google.golang.org/api/googleapi"
 )
 
 const (
 	// Mime-Type used by Google Drive to indicate a folder
 	mimeTypeFolder = "application/vnd.google-apps.folder"
 
-	// Directory in Google Drive to hold temporary copies of files during inserts
+	// Default directory in Google Drive to hold temporary copies of files
+	// during inserts (see SetTmpFolder)
 	driveTmpFolder = "tmp"
 
-	// Total number of tries when we get a 5xx from Gdrive (includes first attempt)
+	// Default total number of tries when we get a 5xx from Gdrive (includes first attempt)
 	numTries = 3
+
+	// Default base delay for the exponential backoff between retries
+	retryBaseDelay = time.Second
+
+	// Maximum number of concurrent requests issued by MergeDir
+	mergeDirWorkers = 4
 )
 
+// defaultExportFormats maps the MIME types of native Google documents to the
+// format used by DownloadToFile when no explicit format is requested.
+var defaultExportFormats = map[string]string{
+	"application/vnd.google-apps.document":     "application/pdf",
+	"application/vnd.google-apps.spreadsheet":  "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	"application/vnd.google-apps.presentation": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+}
+
 // Gdrive is the main structure representing a GoDrive object
 type Gdrive struct {
 	clientID     string
@@ -42,38 +65,251 @@ type Gdrive struct {
 	cacheFile    string
 
 	transport *oauth.Transport
+	tokenMu   sync.Mutex
 	client    *http.Client
 	service   *drive.Service
 
-	log *logger.Logger
+	// Logger used for diagnostics, and the default logger (the only one
+	// affected by SetDebugLevel and SetVerboseLevel.)
+	log    Logger
+	deflog *logger.Logger
+
+	// Follow symbolic links when uploading local files
+	followSymlinks bool
+
+	// Log mutating operations instead of executing them
+	dryRun bool
+
+	// Directory holding temporary copies of files during inserts
+	tmpFolder string
+
+	// Shared drive (Team Drive) holding all objects (blank = My Drive)
+	driveID string
 
-	// caches (one for Drive.File objects, another for child objects)
+	// ID of the directory all paths are relative to (blank = root of the drive)
+	rootFolder string
+
+	// caches (one for Drive.File objects, another for child objects and
+	// another for Drive.File objects keyed by ID)
 	filecache  *map[string]*objCache
 	childcache *map[string]*objCache
+	idcache    *map[string]*objCache
+	cacheTTL   time.Duration
+
+	// Cache of objects not found, and how long they are kept (zero = disabled)
+	negcache    *map[string]*objCache
+	negativeTTL time.Duration
+
+	// Number of objects requested per page in listings (zero = server default)
+	pageSize int64
+
+	// How often cached objects are checked for changes (zero = never)
+	validationInterval time.Duration
+
+	// Decides whether failed operations are retried (nil = default policy)
+	retryPredicate func(err error, attempt int) bool
+
+	// Maximum number of tries and base delay for the exponential backoff
+	maxTries  int
+	retryBase time.Duration
+
+	// Client side rate limiter for API calls (nil = unlimited)
+	limiter *rate.Limiter
+
+	// Called after every API call with its duration and outcome (nil = none)
+	metricsHook func(op string, duration time.Duration, err error)
+}
+
+// CacheNeverExpires can be used as Options.CacheTTL to keep cached objects
+// until they are invalidated, like SetCacheTTL(0). A zero Options.CacheTTL
+// selects the default TTL instead.
+const CacheNeverExpires = time.Duration(math.MaxInt64)
+
+// Options holds the configuration of a new *Gdrive object, as passed to
+// NewGoDriveWithOptions. Fields left at their zero value select the defaults.
+// Each field has the same effect as the corresponding setter.
+type Options struct {
+	// Authentication parameters (see NewGoDrive)
+	ClientID     string
+	ClientSecret string
+	Code         string
+	Scope        string
+	CacheFile    string
+
+	// Cache TTL (see SetCacheTTL.) Zero selects the default of 60 seconds,
+	// CacheNeverExpires keeps objects forever and a negative value disables
+	// the cache.
+	CacheTTL time.Duration
+
+	// Validation interval of cached objects (see SetValidationInterval)
+	ValidationInterval time.Duration
+
+	// Lifetime of cached failed lookups (see SetNegativeCacheTTL)
+	NegativeCacheTTL time.Duration
+
+	// Skip symbolic links when uploading local files (see SetFollowSymlinks)
+	NoFollowSymlinks bool
+
+	// Log levels (see SetDebugLevel and SetVerboseLevel)
+	DebugLevel   int
+	VerboseLevel int
+
+	// Maximum number of tries and base retry delay (see SetRetryPolicy)
+	MaxTries  int
+	RetryBase time.Duration
+
+	// Requests per second and burst size (see SetRateLimit)
+	RateLimit float64
+	RateBurst int
+
+	// Objects requested per page in listings (see SetPageSize)
+	PageSize int
+
+	// Directory holding temporary files during inserts (see SetTmpFolder)
+	TmpFolder string
+
+	// Shared drive to work on (see SetDriveID)
+	DriveID string
+
+	// Directory all paths are relative to (see SetRoot.) It is resolved
+	// right after authentication.
+	Root string
+}
+
+// Logger is the interface used by godrive to log diagnostic messages. Debug
+// and verbose messages are only shown if 'level' is at or below the current
+// debug or verbose level. *logger.Logger (the default) implements it; adapters
+// for other logging libraries can be set with SetLogger.
+type Logger interface {
+	Debugf(level int, format string, v ...interface{})
+	Verbosef(level int, format string, v ...interface{})
 }
 
 // NewGoDrive creates and returns a new *Gdrive Object or (nil, error) in case of problems.
 func NewGoDrive(clientID string, clientSecret string, code string, scope string, cacheFile string) (*Gdrive, error) {
-	if clientID == "" || clientSecret == "" {
+	return NewGoDriveWithOptions(Options{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Code:         code,
+		Scope:        scope,
+		CacheFile:    cacheFile,
+	})
+}
+
+// NewGoDriveWithOptions creates and returns a new *Gdrive Object configured
+// according to 'opts', or (nil, error) in case of problems. The individual
+// setters can still be used to change the configuration later.
+func NewGoDriveWithOptions(opts Options) (*Gdrive, error) {
+	if opts.ClientID == "" || opts.ClientSecret == "" {
 		return nil, fmt.Errorf("NewGoDrive: Need both clientId and clientSecret")
 	}
 
-	g := &Gdrive{clientID: clientID, clientSecret: clientSecret, code: code, scope: scope, cacheFile: cacheFile}
+	g := newGdrive(opts)
+	g.clientID = opts.ClientID
+	g.clientSecret = opts.ClientSecret
+	g.code = opts.Code
+	g.scope = opts.Scope
+	g.cacheFile = opts.CacheFile
+
 	err := g.authenticate()
 	if err != nil {
 		return nil, err
 	}
 	g.client = g.transport.Client()
 	g.service, err = drive.New(g.client)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Root != "" {
+		if err = g.SetRoot(opts.Root); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// newGdrive returns a new *Gdrive with the logger and caches initialized and
+// the configuration in 'opts' applied. Authentication is left to the caller.
+func newGdrive(opts Options) *Gdrive {
+	g := &Gdrive{followSymlinks: !opts.NoFollowSymlinks, tmpFolder: driveTmpFolder}
 
 	// Logger method
-	g.log = logger.New("")
+	g.deflog = logger.New("")
+	g.deflog.SetDebugLevel(opts.DebugLevel)
+	g.deflog.SetVerboseLevel(opts.VerboseLevel)
+	g.log = g.deflog
 
 	// Initialize blank caches
 	g.filecache = &map[string]*objCache{}
 	g.childcache = &map[string]*objCache{}
+	g.idcache = &map[string]*objCache{}
+	g.negcache = &map[string]*objCache{}
+	g.negativeTTL = opts.NegativeCacheTTL
+	g.cacheTTL = cacheTTLSeconds * time.Second
+	if opts.CacheTTL != 0 {
+		g.SetCacheTTL(opts.CacheTTL)
+	}
+	g.validationInterval = opts.ValidationInterval
+	g.SetPageSize(opts.PageSize)
+
+	// Retry policy and rate limit
+	g.SetRetryPolicy(opts.MaxTries, opts.RetryBase)
+	g.SetRateLimit(opts.RateLimit, opts.RateBurst)
+
+	g.SetTmpFolder(opts.TmpFolder)
+	g.driveID = opts.DriveID
+
+	return g
+}
 
-	return g, err
+// NewGoDriveServiceAccount creates and returns a new *Gdrive Object
+// authenticated as the service account whose JSON key is stored in
+// 'jsonKeyPath', or (nil, error) in case of problems. No user interaction is
+// required, making this suitable for unattended use. If 'subject' is not
+// blank, the service account impersonates that user (this requires domain-wide
+// delegation to be enabled for the service account.)
+func NewGoDriveServiceAccount(jsonKeyPath string, subject string, scope string) (*Gdrive, error) {
+	if jsonKeyPath == "" || scope == "" {
+		return nil, fmt.Errorf("NewGoDriveServiceAccount: Need both jsonKeyPath and scope")
+	}
+	jsonKey, err := ioutil.ReadFile(jsonKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("NewGoDriveServiceAccount: Error reading key file \"%s\": %w", jsonKeyPath, err)
+	}
+	config, err := google.JWTConfigFromJSON(jsonKey, scope)
+	if err != nil {
+		return nil, fmt.Errorf("NewGoDriveServiceAccount: Error parsing key file \"%s\": %w", jsonKeyPath, err)
+	}
+	config.Subject = subject
+
+	g := newGdrive(Options{})
+	g.scope = scope
+	g.client = config.Client(context.Background())
+	g.service, err = drive.New(g.client)
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// NewGoDriveWithClient creates and returns a new *Gdrive Object using
+// 'client' for all requests, or (nil, error) in case of problems. The client
+// must already be authenticated (e.g. created with golang.org/x/oauth2) and
+// is responsible for refreshing its own tokens.
+func NewGoDriveWithClient(client *http.Client) (*Gdrive, error) {
+	if client == nil {
+		return nil, fmt.Errorf("NewGoDriveWithClient: Need a non-nil client")
+	}
+
+	g := newGdrive(Options{})
+	g.client = client
+	service, err := drive.New(client)
+	if err != nil {
+		return nil, err
+	}
+	g.service = service
+	return g, nil
 }
 
 // authenticate authenticates the newly created object using clientId,
@@ -112,7 +348,7 @@ func (g *Gdrive) authenticate() error {
 		// If everything works, the Exchange method will cache the token.
 		token, err = g.transport.Exchange(g.code)
 		if err != nil {
-			return fmt.Errorf("authenticate: Error exchanging code for token: %v", err)
+			return fmt.Errorf("authenticate: Error exchanging code for token: %w", err)
 		}
 	}
 
@@ -120,15 +356,74 @@ func (g *Gdrive) authenticate() error {
 	return nil
 }
 
+// RefreshToken forces a refresh of the OAuth token used by this object. This
+// is only supported for objects created with NewGoDrive or
+// NewGoDriveWithOptions; other clients are responsible for their own tokens.
+func (g *Gdrive) RefreshToken() error {
+	if g.transport == nil {
+		return fmt.Errorf("RefreshToken: Token refresh not supported by this client")
+	}
+	g.tokenMu.Lock()
+	defer g.tokenMu.Unlock()
+
+	if err := g.transport.Refresh(); err != nil {
+		return fmt.Errorf("RefreshToken: Error refreshing token: %w", err)
+	}
+	return nil
+}
+
+// TokenExpiry returns the expiration time of the current OAuth token, or the
+// zero time if unknown (e.g. objects created with NewGoDriveWithClient.)
+func (g *Gdrive) TokenExpiry() time.Time {
+	if g.transport == nil {
+		return time.Time{}
+	}
+	g.tokenMu.Lock()
+	defer g.tokenMu.Unlock()
+
+	if g.transport.Token == nil {
+		return time.Time{}
+	}
+	return g.transport.Token.Expiry
+}
+
+// Service returns the underlying *drive.Service, allowing direct access to
+// the parts of the Google Drive API not covered by this library. Changes made
+// through it are not reflected in the cache (see InvalidatePath.)
+func (g *Gdrive) Service() *drive.Service {
+	return g.service
+}
+
+// HTTPClient returns the authenticated *http.Client used by this object.
+func (g *Gdrive) HTTPClient() *http.Client {
+	return g.client
+}
+
 //------------------------------------------------------------------------------
 //	Gdrive Primitives: Direct interfaces with Gdrive
 //------------------------------------------------------------------------------
 
 // GdriveFilesGet returns a *drive.File object for the object identified by 'fileId'
 func (g *Gdrive) GdriveFilesGet(fileID string) (*drive.File, error) {
-	f, err := driveFileOpRetry(g.service.Files.Get(fileID).Do)
+	return g.GdriveFilesGetContext(context.Background(), fileID)
+}
+
+// GdriveFilesGetContext works like GdriveFilesGet, but the request and any
+// retries are bound to 'ctx'.
+func (g *Gdrive) GdriveFilesGetContext(ctx context.Context, fileID string) (*drive.File, error) {
+	f, err := g.driveFileOpRetry(ctx, "Files.Get", g.service.Files.Get(fileID).SupportsAllDrives(g.driveID != "").Context(ctx).Do)
+	if err != nil {
+		return nil, fmt.Errorf("GdriveFilesGet: Error retrieving File Metadata for fileId \"%s\": %w", fileID, err)
+	}
+	return f, nil
+}
+
+// gdriveFilesGetFields works like GdriveFilesGetContext, but only fetches the
+// fields listed in 'fields' (comma separated.)
+func (g *Gdrive) gdriveFilesGetFields(ctx context.Context, fileID string, fields string) (*drive.File, error) {
+	f, err := g.driveFileOpRetry(ctx, "Files.Get", g.service.Files.Get(fileID).Fields(googleapi.Field(fields)).SupportsAllDrives(g.driveID != "").Context(ctx).Do)
 	if err != nil {
-		return nil, fmt.Errorf("GdriveFilesGet: Error retrieving File Metadata for fileId \"%s\": %v", fileID, err)
+		return nil, fmt.Errorf("GdriveFilesGet: Error retrieving File Metadata for fileId \"%s\": %w", fileID, err)
 	}
 	return f, nil
 }
@@ -136,18 +431,44 @@ func (g *Gdrive) GdriveFilesGet(fileID string) (*drive.File, error) {
 // GdriveChildrenList returns a slice of *drive.ChilReference containing all
 // objects under 'ParentId' which satisfy the 'query' parameter.
 func (g *Gdrive) GdriveChildrenList(parentID string, query string) ([]*drive.ChildReference, error) {
+	return g.GdriveChildrenListContext(context.Background(), parentID, query)
+}
+
+// GdriveChildrenListContext works like GdriveChildrenList, but all page
+// requests (and their retries) are bound to 'ctx'. Children.List cannot be
+// scoped to a shared drive, so when one is set (see SetDriveID) the children
+// are listed with Files.List instead.
+func (g *Gdrive) GdriveChildrenListContext(ctx context.Context, parentID string, query string) ([]*drive.ChildReference, error) {
 	var ret []*drive.ChildReference
 
+	if g.driveID != "" {
+		q := fmt.Sprintf("'%s' in parents", parentID)
+		if query != "" {
+			q += " and (" + query + ")"
+		}
+		err := g.gdriveFilesListFunc(ctx, q, "id", "", func(driveFile *drive.File) error {
+			ret = append(ret, &drive.ChildReference{Id: driveFile.Id})
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("GdriveChildrenList: fetching Id for parent_id \"%s\", query=\"%s\": %w", parentID, query, err)
+		}
+		return ret, nil
+	}
+
 	pageToken := ""
 	for {
-		c := g.service.Children.List(parentID)
+		c := g.service.Children.List(parentID).Context(ctx)
 		c.Q(query)
+		if g.pageSize > 0 {
+			c = c.MaxResults(g.pageSize)
+		}
 		if pageToken != "" {
 			c = c.PageToken(pageToken)
 		}
-		r, err := driveChildListOpRetry(c.Do)
+		r, err := g.driveChildListOpRetry(ctx, "Children.List", c.Do)
 		if err != nil {
-			return nil, fmt.Errorf("GdriveChildrenList: fetching Id for parent_id \"%s\", query=\"%s\": %v", parentID, query, err)
+			return nil, fmt.Errorf("GdriveChildrenList: fetching Id for parent_id \"%s\", query=\"%s\": %w", parentID, query, err)
 		}
 		ret = append(ret, r.Items...)
 		pageToken = r.NextPageToken
@@ -158,35 +479,127 @@ func (g *Gdrive) GdriveChildrenList(parentID string, query string) ([]*drive.Chi
 	return ret, nil
 }
 
+// GdriveFilesList returns a slice of *drive.File containing all objects in
+// Google Drive (not restricted to a single folder) which satisfy the 'query'
+// parameter. If 'fields' is not blank, only the listed fields (comma
+// separated, e.g. "id,title") of each object will be fetched, greatly reducing
+// the size of the response on large listings.
+func (g *Gdrive) GdriveFilesList(query string, fields string) ([]*drive.File, error) {
+	var ret []*drive.File
+
+	err := g.GdriveFilesListFunc(query, fields, func(driveFile *drive.File) error {
+		ret = append(ret, driveFile)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// GdriveFilesListFunc works like GdriveFilesList, but calls 'fn' for each
+// object as pages arrive instead of returning them all at once. The listing
+// stops and the error is returned if 'fn' returns an error.
+func (g *Gdrive) GdriveFilesListFunc(query string, fields string, fn func(*drive.File) error) error {
+	return g.gdriveFilesListFunc(context.Background(), query, fields, "", fn)
+}
+
+// gdriveFilesListFunc works like GdriveFilesListFunc, returning the objects
+// sorted according to 'orderBy' (e.g. "modifiedDate desc,title") if not blank.
+// All page requests (and their retries) are bound to 'ctx'.
+func (g *Gdrive) gdriveFilesListFunc(ctx context.Context, query string, fields string, orderBy string, fn func(*drive.File) error) error {
+	pageToken := ""
+	for {
+		c := g.service.Files.List().Context(ctx)
+		c.Q(query)
+		if g.driveID != "" {
+			c = c.Corpora("drive").DriveId(g.driveID).IncludeItemsFromAllDrives(true).SupportsAllDrives(true)
+		}
+		if fields != "" {
+			c = c.Fields("nextPageToken", googleapi.Field("items("+fields+")"))
+		}
+		if orderBy != "" {
+			c = c.OrderBy(orderBy)
+		}
+		if g.pageSize > 0 {
+			c = c.MaxResults(g.pageSize)
+		}
+		if pageToken != "" {
+			c = c.PageToken(pageToken)
+		}
+		r, err := g.driveFileListOpRetry(ctx, "Files.List", c.Do)
+		if err != nil {
+			return fmt.Errorf("GdriveFilesList: fetching files for query=\"%s\": %w", query, err)
+		}
+		for _, driveFile := range r.Items {
+			if err = fn(driveFile); err != nil {
+				return err
+			}
+		}
+		pageToken = r.NextPageToken
+		if pageToken == "" {
+			break
+		}
+	}
+	return nil
+}
+
+// GdriveFilesCopy creates a server side copy of the object indicated by
+// 'fileID', named 'title', under 'parentID'. No data is transferred through
+// the client. Returns a *drive.File object pointing to the new copy.
+func (g *Gdrive) GdriveFilesCopy(fileID string, title string, parentID string) (*drive.File, error) {
+	driveFile := &drive.File{
+		Title:   title,
+		Parents: []*drive.ParentReference{{Id: parentID}},
+	}
+	if g.dryRun {
+		g.log.Verbosef(1, "Dry run: Copy fileId \"%s\" to \"%s\"\n", fileID, title)
+		return driveFile, nil
+	}
+	return g.driveFileOpRetry(context.Background(), "Files.Copy", g.service.Files.Copy(fileID, driveFile).SupportsAllDrives(g.driveID != "").Do)
+}
+
 // GdriveFilesInsert inserts a new Object (file/dir) on Google Drive under
 // 'parentId'. The object's contents will come from 'reader' (io.Reader). If
 // reader is nil, an empty object will be created (this is how we create
 // directories). The title of the object will be set to 'title' and the
 // object's MIME Type will be set to 'mimeType', or automatically detected if
-// mimeType is blank.
+// mimeType is blank. Files are never converted to native Google documents.
 //
 // Returns a *drive.File object pointing to the file just inserted.
 func (g *Gdrive) GdriveFilesInsert(reader io.Reader, title string, parentID string, mimeType string) (*drive.File, error) {
-	var (
-		err       error
-		driveFile *drive.File
-		ret       *drive.File
-	)
-
-	driveFile = &drive.File{Title: title, MimeType: mimeType}
-	if mimeType != "" {
-		driveFile.MimeType = mimeType
-	}
+	driveFile := &drive.File{Title: title, MimeType: mimeType}
 	// Set parentId
 	if parentID != "" {
 		p := &drive.ParentReference{Id: parentID}
 		driveFile.Parents = []*drive.ParentReference{p}
 	}
-	if reader != nil {
-		ret, err = driveFileOpRetry(g.service.Files.Insert(driveFile).Media(reader).Do)
-	} else {
-		ret, err = driveFileOpRetry(g.service.Files.Insert(driveFile).Do)
+	return g.gdriveFilesInsert(reader, driveFile, false)
+}
+
+// gdriveFilesInsert inserts a new Object (file/dir) on Google Drive described
+// by 'driveFile' (title, parents and any other metadata to be set at creation
+// time.) The object's contents will come from 'reader', or an empty object
+// will be created if reader is nil. Uploaded files are stored verbatim, unless
+// 'convert' is true, in which case Google Drive converts them to the
+// corresponding native Google document format, when possible. Failed requests
+// are only retried if reader is nil or implements io.Seeker (see
+// driveMediaOpRetry.)
+//
+// Returns a *drive.File object pointing to the file just inserted.
+func (g *Gdrive) gdriveFilesInsert(reader io.Reader, driveFile *drive.File, convert bool) (*drive.File, error) {
+	if g.dryRun {
+		g.log.Verbosef(1, "Dry run: Insert \"%s\"\n", driveFile.Title)
+		ret := *driveFile
+		return &ret, nil
 	}
+	ret, err := g.driveMediaOpRetry(context.Background(), "Files.Insert", reader, func(reader io.Reader) (*drive.File, error) {
+		c := g.service.Files.Insert(driveFile).Convert(convert).Ocr(false).SupportsAllDrives(g.driveID != "")
+		if reader != nil {
+			c = c.Media(reader)
+		}
+		return c.Do()
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -207,25 +620,354 @@ func (g *Gdrive) GdriveFilesPatch(fileID string, title string, modifiedDate stri
 	if modifiedDate != "" {
 		driveFile.ModifiedDate = modifiedDate
 	}
-	p := g.service.Files.Patch(fileID, driveFile)
+	return g.gdriveFilesPatch(fileID, driveFile, addParentIds, removeParentIds)
+}
+
+// gdriveFilesPatch patches the metadata of the object identified by 'fileID'
+// with the fields set in 'driveFile'. Fields holding their zero value are left
+// untouched, unless listed in driveFile.ForceSendFields. The modification date
+// is only changed if driveFile.ModifiedDate is set (by default, Google Drive
+// sets it to the current time on every patch.) Parent Ids in
+// 'addParentIds' and 'removeParentIds' are added and removed, respectively.
+//
+// Returns a *drive.File object pointing to the modified file.
+func (g *Gdrive) gdriveFilesPatch(fileID string, driveFile *drive.File, addParentIds []string, removeParentIds []string) (*drive.File, error) {
+	if g.dryRun {
+		g.log.Verbosef(1, "Dry run: Patch fileId \"%s\" (add parents: %v, remove parents: %v)\n", fileID, addParentIds, removeParentIds)
+		ret := *driveFile
+		ret.Id = fileID
+		return &ret, nil
+	}
+	p := g.service.Files.Patch(fileID, driveFile).SupportsAllDrives(g.driveID != "")
 	if len(addParentIds) > 0 {
 		p.AddParents(strings.Join(addParentIds, ","))
 	}
 	if len(removeParentIds) > 0 {
 		p.RemoveParents(strings.Join(removeParentIds, ","))
 	}
-	if modifiedDate != "" {
+	if driveFile.ModifiedDate != "" {
 		p.SetModifiedDate(true)
+	} else {
+		p.ModifiedDateBehavior("noChange")
 	}
-	r, err := driveFileOpRetry(p.Do)
+	r, err := g.driveFileOpRetry(context.Background(), "Files.Patch", p.Do)
 	if err != nil {
 		return nil, err
 	}
 	return r, nil
 }
 
+// GdriveFilesUpdate replaces the contents of the object identified by
+// 'fileID' with the contents read from 'reader', keeping its ID, metadata,
+// parents and permissions. A new revision is created. Failed requests are only
+// retried if 'reader' implements io.Seeker (see driveMediaOpRetry.)
+//
+// Returns a *drive.File object pointing to the updated file.
+func (g *Gdrive) GdriveFilesUpdate(fileID string, reader io.Reader) (*drive.File, error) {
+	if g.dryRun {
+		g.log.Verbosef(1, "Dry run: Update fileId \"%s\"\n", fileID)
+		return &drive.File{Id: fileID}, nil
+	}
+	return g.driveMediaOpRetry(context.Background(), "Files.Update", reader, func(reader io.Reader) (*drive.File, error) {
+		return g.service.Files.Update(fileID, &drive.File{}).Media(reader).SupportsAllDrives(g.driveID != "").Do()
+	})
+}
+
 // GdriveFilesTrash moves the object indicated by 'fileID' to the Google Drive
 // Trash.  Returns a *drive.File object pointing to the file inside Trash.
 func (g *Gdrive) GdriveFilesTrash(fileID string) (*drive.File, error) {
-	return driveFileOpRetry(g.service.Files.Trash(fileID).Do)
+	if g.dryRun {
+		g.log.Verbosef(1, "Dry run: Trash fileId \"%s\"\n", fileID)
+		return &drive.File{Id: fileID}, nil
+	}
+	return g.driveFileOpRetry(context.Background(), "Files.Trash", g.service.Files.Trash(fileID).SupportsAllDrives(g.driveID != "").Do)
+}
+
+// GdriveFilesDelete permanently deletes the object indicated by 'fileID',
+// skipping the trash. This operation cannot be undone.
+func (g *Gdrive) GdriveFilesDelete(fileID string) error {
+	if g.dryRun {
+		g.log.Verbosef(1, "Dry run: Delete fileId \"%s\"\n", fileID)
+		return nil
+	}
+	return g.driveOpRetry(context.Background(), g.measure("Files.Delete", g.service.Files.Delete(fileID).SupportsAllDrives(g.driveID != "").Do))
+}
+
+// GdriveFilesUntrash restores the object indicated by 'fileID' from the
+// Google Drive Trash. Returns a *drive.File object pointing to the restored
+// file.
+func (g *Gdrive) GdriveFilesUntrash(fileID string) (*drive.File, error) {
+	if g.dryRun {
+		g.log.Verbosef(1, "Dry run: Untrash fileId \"%s\"\n", fileID)
+		return &drive.File{Id: fileID}, nil
+	}
+	return g.driveFileOpRetry(context.Background(), "Files.Untrash", g.service.Files.Untrash(fileID).SupportsAllDrives(g.driveID != "").Do)
+}
+
+// GdriveFilesEmptyTrash permanently deletes all of the user's trashed files.
+func (g *Gdrive) GdriveFilesEmptyTrash() error {
+	if g.dryRun {
+		g.log.Verbosef(1, "Dry run: Empty trash\n")
+		return nil
+	}
+	return g.driveOpRetry(context.Background(), g.measure("Files.EmptyTrash", g.service.Files.EmptyTrash().Do))
+}
+
+// GdrivePermissionsInsert adds the permission 'perm' to the object indicated
+// by 'fileID'. Returns the *drive.Permission just inserted.
+func (g *Gdrive) GdrivePermissionsInsert(fileID string, perm *drive.Permission) (*drive.Permission, error) {
+	if g.dryRun {
+		g.log.Verbosef(1, "Dry run: Insert permission for fileId \"%s\"\n", fileID)
+		ret := *perm
+		return &ret, nil
+	}
+
+	var ret *drive.Permission
+
+	err := g.driveOpRetry(context.Background(), g.measure("Permissions.Insert", func() error {
+		var err error
+		ret, err = g.service.Permissions.Insert(fileID, perm).SupportsAllDrives(g.driveID != "").Do()
+		return err
+	}))
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// GdrivePermissionsList returns a slice of *drive.Permission containing all
+// permissions set on the object indicated by 'fileID'.
+func (g *Gdrive) GdrivePermissionsList(fileID string) ([]*drive.Permission, error) {
+	var ret *drive.PermissionList
+
+	err := g.driveOpRetry(context.Background(), g.measure("Permissions.List", func() error {
+		var err error
+		ret, err = g.service.Permissions.List(fileID).SupportsAllDrives(g.driveID != "").Do()
+		return err
+	}))
+	if err != nil {
+		return nil, err
+	}
+	return ret.Items, nil
+}
+
+// GdrivePermissionsDelete removes the permission 'permissionID' from the
+// object indicated by 'fileID'.
+func (g *Gdrive) GdrivePermissionsDelete(fileID string, permissionID string) error {
+	if g.dryRun {
+		g.log.Verbosef(1, "Dry run: Delete permission \"%s\" from fileId \"%s\"\n", permissionID, fileID)
+		return nil
+	}
+	return g.driveOpRetry(context.Background(), g.measure("Permissions.Delete", g.service.Permissions.Delete(fileID, permissionID).SupportsAllDrives(g.driveID != "").Do))
+}
+
+// GdrivePropertiesInsert adds the property 'prop' to the object indicated by
+// 'fileID', replacing any existing property with the same key and visibility.
+// Returns the *drive.Property just inserted.
+func (g *Gdrive) GdrivePropertiesInsert(fileID string, prop *drive.Property) (*drive.Property, error) {
+	if g.dryRun {
+		g.log.Verbosef(1, "Dry run: Insert property \"%s\" for fileId \"%s\"\n", prop.Key, fileID)
+		ret := *prop
+		return &ret, nil
+	}
+
+	var ret *drive.Property
+
+	err := g.driveOpRetry(context.Background(), g.measure("Properties.Insert", func() error {
+		var err error
+		ret, err = g.service.Properties.Insert(fileID, prop).Do()
+		return err
+	}))
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// GdrivePropertiesList returns a slice of *drive.Property containing all
+// properties of the object indicated by 'fileID' visible to this application.
+func (g *Gdrive) GdrivePropertiesList(fileID string) ([]*drive.Property, error) {
+	var ret *drive.PropertyList
+
+	err := g.driveOpRetry(context.Background(), g.measure("Properties.List", func() error {
+		var err error
+		ret, err = g.service.Properties.List(fileID).Do()
+		return err
+	}))
+	if err != nil {
+		return nil, err
+	}
+	return ret.Items, nil
+}
+
+// GdriveRevisionsList returns a slice of *drive.Revision containing all
+// revisions of the object indicated by 'fileID'.
+func (g *Gdrive) GdriveRevisionsList(fileID string) ([]*drive.Revision, error) {
+	var ret *drive.RevisionList
+
+	err := g.driveOpRetry(context.Background(), g.measure("Revisions.List", func() error {
+		var err error
+		ret, err = g.service.Revisions.List(fileID).Do()
+		return err
+	}))
+	if err != nil {
+		return nil, err
+	}
+	return ret.Items, nil
+}
+
+// GdriveRevisionsGet returns the *drive.Revision 'revisionID' of the object
+// indicated by 'fileID'.
+func (g *Gdrive) GdriveRevisionsGet(fileID string, revisionID string) (*drive.Revision, error) {
+	var ret *drive.Revision
+
+	err := g.driveOpRetry(context.Background(), g.measure("Revisions.Get", func() error {
+		var err error
+		ret, err = g.service.Revisions.Get(fileID, revisionID).Do()
+		return err
+	}))
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// GdriveRevisionsPatch patches the metadata of revision 'revisionID' of the
+// object indicated by 'fileID' with the fields set in 'rev'. Returns the
+// modified *drive.Revision.
+func (g *Gdrive) GdriveRevisionsPatch(fileID string, revisionID string, rev *drive.Revision) (*drive.Revision, error) {
+	if g.dryRun {
+		g.log.Verbosef(1, "Dry run: Patch revision \"%s\" of fileId \"%s\"\n", revisionID, fileID)
+		ret := *rev
+		ret.Id = revisionID
+		return &ret, nil
+	}
+
+	var ret *drive.Revision
+
+	err := g.driveOpRetry(context.Background(), g.measure("Revisions.Patch", func() error {
+		var err error
+		ret, err = g.service.Revisions.Patch(fileID, revisionID, rev).Do()
+		return err
+	}))
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// GdriveChangesList returns a page of changes made to Google Drive starting
+// at 'pageToken', including deleted objects.
+func (g *Gdrive) GdriveChangesList(pageToken string) (*drive.ChangeList, error) {
+	var ret *drive.ChangeList
+
+	err := g.driveOpRetry(context.Background(), g.measure("Changes.List", func() error {
+		var err error
+		c := g.service.Changes.List().PageToken(pageToken).IncludeDeleted(true)
+		if g.pageSize > 0 {
+			c = c.MaxResults(g.pageSize)
+		}
+		if g.driveID != "" {
+			c = c.DriveId(g.driveID).IncludeItemsFromAllDrives(true).SupportsAllDrives(true)
+		}
+		ret, err = c.Do()
+		return err
+	}))
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// GdriveChangesGetStartPageToken returns the page token pointing to the
+// current state of Google Drive, to be used with GdriveChangesList.
+func (g *Gdrive) GdriveChangesGetStartPageToken() (string, error) {
+	var ret *drive.StartPageToken
+
+	err := g.driveOpRetry(context.Background(), g.measure("Changes.GetStartPageToken", func() error {
+		var err error
+		c := g.service.Changes.GetStartPageToken()
+		if g.driveID != "" {
+			c = c.DriveId(g.driveID).SupportsAllDrives(true)
+		}
+		ret, err = c.Do()
+		return err
+	}))
+	if err != nil {
+		return "", err
+	}
+	return ret.StartPageToken, nil
+}
+
+// GdriveAboutGet returns a *drive.About object containing information about
+// the current user and their Google Drive settings (including quotas.)
+func (g *Gdrive) GdriveAboutGet() (*drive.About, error) {
+	var about *drive.About
+
+	err := g.driveOpRetry(context.Background(), g.measure("About.Get", func() error {
+		var err error
+		about, err = g.service.About.Get().Do()
+		return err
+	}))
+	if err != nil {
+		return nil, fmt.Errorf("GdriveAboutGet: Error retrieving Drive information: %w", err)
+	}
+	return about, nil
+}
+
+// fetchURL issues an authenticated GET request to 'url' and returns an
+// io.ReadCloser to the response body. Any response other than a 2xx is
+// returned as an *APIError (wrapping the error payload sent by the server)
+// and the body is closed.
+func (g *Gdrive) fetchURL(ctx context.Context, url string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	var resp *http.Response
+	err = g.measure("Download", func() error {
+		var err error
+		resp, err = g.client.Do(req)
+		if err != nil {
+			return err
+		}
+		if err = googleapi.CheckResponse(resp); err != nil {
+			resp.Body.Close()
+			return newAPIError(err)
+		}
+		return nil
+	})()
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// CancelUpload aborts the resumable upload session identified by
+// 'sessionURI', releasing the session and any partially uploaded data on the
+// server side. Google Drive answers a cancelled session with HTTP 499, which
+// is considered a success here.
+func (g *Gdrive) CancelUpload(sessionURI string) error {
+	req, err := http.NewRequest("DELETE", sessionURI, nil)
+	if err != nil {
+		return err
+	}
+	err = g.measure("Upload.Cancel", func() error {
+		resp, err := g.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == 499 {
+			return nil
+		}
+		return googleapi.CheckResponse(resp)
+	})()
+	if err != nil {
+		return fmt.Errorf("CancelUpload: Error cancelling upload session: %w", err)
+	}
+	return nil
 }
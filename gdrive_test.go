@@ -0,0 +1,172 @@
+package godrive
+
+// Fake Google Drive service for godrive tests
+//
+// This file is part of the godrive library
+//
+// (C) 2015 by Marco Paganini <paganini@paganini.net>
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/drive/v2"
+)
+
+var (
+	reQueryTitle    = regexp.MustCompile(`title = '((?:[^'\\]|\\.)*)'`)
+	reQueryMimeType = regexp.MustCompile(`mimeType (!?=) '([^']*)'`)
+	reQueryParent   = regexp.MustCompile(`'([^']*)' in parents`)
+)
+
+// fakeDrive is a minimal in-memory Google Drive (API v2) served over HTTP. It
+// supports Files.Get, Children.List and Files.List with the queries issued by
+// Stat and Walk, and downloads through handlers registered under "/download/".
+// All requests served are counted in 'requests'.
+type fakeDrive struct {
+	mu        sync.Mutex
+	url       string
+	files     map[string]*drive.File
+	downloads map[string]http.HandlerFunc
+	nextID    int
+	requests  int
+}
+
+// newTestGdrive returns a *Gdrive talking to a new (empty) fakeDrive, along
+// with the fakeDrive itself. Failed requests are not retried.
+func newTestGdrive(t *testing.T) (*Gdrive, *fakeDrive) {
+	fd := &fakeDrive{
+		files:     make(map[string]*drive.File),
+		downloads: make(map[string]http.HandlerFunc),
+	}
+	srv := httptest.NewServer(fd)
+	t.Cleanup(srv.Close)
+	fd.url = srv.URL
+
+	g := newGdrive(Options{})
+	g.client = srv.Client()
+	service, err := drive.New(g.client)
+	if err != nil {
+		t.Fatalf("drive.New: %v", err)
+	}
+	service.BasePath = srv.URL + "/"
+	g.service = service
+	g.SetRetryPolicy(1, time.Millisecond)
+	return g, fd
+}
+
+// add adds an object named 'title' under 'parentID' ("root" for the root
+// directory) and returns it. Directories are created if 'dir' is true.
+func (fd *fakeDrive) add(parentID string, title string, dir bool) *drive.File {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+
+	fd.nextID++
+	driveFile := &drive.File{
+		Id:      fmt.Sprintf("id%d", fd.nextID),
+		Title:   title,
+		Parents: []*drive.ParentReference{{Id: parentID, IsRoot: parentID == "root"}},
+	}
+	if dir {
+		driveFile.MimeType = mimeTypeFolder
+	}
+	fd.files[driveFile.Id] = driveFile
+	return driveFile
+}
+
+// setDownload makes the download URL of 'driveFile' point to 'name' under
+// "/download/", served by 'fn'.
+func (fd *fakeDrive) setDownload(driveFile *drive.File, name string, fn http.HandlerFunc) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	driveFile.DownloadUrl = fd.url + "/download/" + name
+	fd.downloads["/download/"+name] = fn
+}
+
+// requestCount returns the number of requests served so far.
+func (fd *fakeDrive) requestCount() int {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	return fd.requests
+}
+
+func (fd *fakeDrive) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+
+	fd.requests++
+	if fn, ok := fd.downloads[r.URL.Path]; ok {
+		fn(w, r)
+		return
+	}
+
+	elems := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == "GET" && len(elems) == 2 && elems[0] == "files":
+		driveFile, ok := fd.files[elems[1]]
+		if !ok {
+			fd.notFound(w, elems[1])
+			return
+		}
+		json.NewEncoder(w).Encode(driveFile)
+	case r.Method == "GET" && len(elems) == 1 && elems[0] == "files":
+		query := r.URL.Query().Get("q")
+		m := reQueryParent.FindStringSubmatch(query)
+		if m == nil {
+			http.Error(w, "fakeDrive only lists files by parent", http.StatusNotImplemented)
+			return
+		}
+		json.NewEncoder(w).Encode(&drive.FileList{Items: fd.children(m[1], query)})
+	case r.Method == "GET" && len(elems) == 3 && elems[0] == "files" && elems[2] == "children":
+		var items []*drive.ChildReference
+		for _, driveFile := range fd.children(elems[1], r.URL.Query().Get("q")) {
+			items = append(items, &drive.ChildReference{Id: driveFile.Id})
+		}
+		json.NewEncoder(w).Encode(&drive.ChildList{Items: items})
+	default:
+		http.Error(w, "not implemented by fakeDrive", http.StatusNotImplemented)
+	}
+}
+
+// children returns the (never trashed) children of 'parentID' matching the
+// title and mimeType conditions in 'query'.
+func (fd *fakeDrive) children(parentID string, query string) []*drive.File {
+	var ret []*drive.File
+
+	title := ""
+	if m := reQueryTitle.FindStringSubmatch(query); m != nil {
+		title = strings.Replace(m[1], `\'`, `'`, -1)
+	}
+	mimeOp, mimeType := "", ""
+	if m := reQueryMimeType.FindStringSubmatch(query); m != nil {
+		mimeOp, mimeType = m[1], m[2]
+	}
+
+	for _, driveFile := range fd.files {
+		if driveFile.Parents[0].Id != parentID {
+			continue
+		}
+		if title != "" && driveFile.Title != title {
+			continue
+		}
+		if (mimeOp == "=" && driveFile.MimeType != mimeType) || (mimeOp == "!=" && driveFile.MimeType == mimeType) {
+			continue
+		}
+		ret = append(ret, driveFile)
+	}
+	return ret
+}
+
+// notFound answers with the error returned by Google Drive for missing files.
+func (fd *fakeDrive) notFound(w http.ResponseWriter, fileID string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprintf(w, `{"error": {"code": 404, "message": "File not found: %s", "errors": [{"reason": "notFound"}]}}`, fileID)
+}
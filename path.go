@@ -10,342 +10,2392 @@ package godrive
 // (C) 2015 by Marco Paganini <paganini@paganini.net>
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
-	"math/rand"
-	"net/http"
+	"io/ioutil"
 	"os"
+	"path"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
-	"code.google.com/p/google-api-go-client/drive/v2"
+	"golang.org/x/time/rate"
+	"google.golang.org/api/drive/v2"
 )
 
-// Download a file from Gdrive. Returns an io.Reader to gdrive file pointed by srcPath.
-// The io.Reader can be used to save the file locally by the caller.
-func (g *Gdrive) Download(srcPath string) (io.Reader, error) {
+// AccountStats returns the total number of files (excluding folders) and the
+// sum of their sizes across the entire account, including files shared with
+// the user and objects not reachable from the root folder. Trashed files are
+// not counted. Native Google Docs have no size and count as zero bytes.
+func (g *Gdrive) AccountStats() (fileCount int, totalBytes int64, err error) {
+	query := fmt.Sprintf("trashed = false and mimeType != '%s'", mimeTypeFolder)
+	files, err := g.GdriveFilesList(query, "fileSize")
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, driveFile := range files {
+		totalBytes += driveFile.FileSize
+	}
+	return len(files), totalBytes, nil
+}
+
+// ApplyChanges removes from the cache all objects mentioned in 'changes' (as
+// returned by Changes), along with any objects cached below them. This keeps
+// the cache consistent with changes made by other clients without flushing
+// it entirely.
+func (g *Gdrive) ApplyChanges(changes []*drive.Change) {
+	ids := make(map[string]bool, len(changes))
+	for _, change := range changes {
+		ids[change.FileId] = true
+	}
+	g.cacheDelIDs(ids)
+}
+
+// cacheAddPath adds 'driveFile' to the cache under 'drivePath', where it was
+// just created or moved to, dropping any cached failed lookups of that path
+// and anything below it (see SetNegativeCacheTTL.)
+func (g *Gdrive) cacheAddPath(drivePath string, driveFile *drive.File) {
+	_, _, drivePath = splitPath(drivePath)
+	cacheAdd(g.filecache, drivePath, driveFile)
+	cacheDelPrefix(g.negcache, drivePath)
+}
+
+// cacheDelIDs removes from the cache every path pointing to one of the file
+// IDs in 'ids' (an object may be cached under several paths, e.g. after Link
+// or a Move), along with any objects cached below those paths.
+func (g *Gdrive) cacheDelIDs(ids map[string]bool) {
+	for id := range ids {
+		cacheDel(g.idcache, id)
+	}
+
+	var paths []string
+	paths = append(paths, cacheKeys(g.filecache, func(obj interface{}) bool {
+		return ids[obj.(*drive.File).Id]
+	})...)
+	paths = append(paths, cacheKeys(g.childcache, func(obj interface{}) bool {
+		return ids[obj.(*drive.ChildReference).Id]
+	})...)
+	for _, drivePath := range paths {
+		g.InvalidatePath(drivePath)
+	}
+}
+
+// Append appends the contents read from 'reader' to the file pointed by
+// 'dstPath', keeping its ID (and thus its sharing settings and revision
+// history.) Google Drive has no native append operation, so this downloads
+// the current contents and uploads them again followed by the new data. This
+// is a read-modify-write operation and is not atomic: concurrent changes to
+// the file made by other clients may be lost.
+func (g *Gdrive) Append(dstPath string, reader io.Reader) (*drive.File, error) {
+	_, _, dstPath = splitPath(dstPath)
+	if dstPath == "" {
+		return nil, fmt.Errorf("Append: empty destination path")
+	}
+	dstFileObj, err := g.Stat(dstPath)
+	if err != nil {
+		return nil, err
+	}
+	if IsDir(dstFileObj) {
+		return nil, fmt.Errorf("Append: \"%s\" is a directory", dstPath)
+	}
+
+	current, err := g.Download(dstPath)
+	if err != nil {
+		return nil, err
+	}
+	defer current.Close()
+
+	driveFile, err := g.GdriveFilesUpdate(dstFileObj.Id, io.MultiReader(current, reader))
+	if err != nil {
+		return nil, fmt.Errorf("Append: Error updating \"%s\": %w", dstPath, err)
+	}
+	g.cacheDelIDs(map[string]bool{driveFile.Id: true})
+	cacheAdd(g.filecache, dstPath, driveFile)
+	cacheAdd(g.idcache, driveFile.Id, driveFile)
+	return driveFile, nil
+}
+
+// Changes returns all changes made to Google Drive since 'startPageToken'
+// (as returned by StartPageToken or a previous call to Changes), and the token
+// to be used in the next call. Persisting this token allows changes to be
+// polled incrementally, without re-listing directories. Cached objects changed
+// are removed from the ID cache.
+func (g *Gdrive) Changes(startPageToken string) (changes []*drive.Change, nextToken string, err error) {
+	if startPageToken == "" {
+		return nil, "", fmt.Errorf("Changes: empty start page token")
+	}
+
+	pageToken := startPageToken
+	for {
+		r, err := g.GdriveChangesList(pageToken)
+		if err != nil {
+			return nil, "", fmt.Errorf("Changes: Error listing changes: %w", err)
+		}
+		for _, change := range r.Items {
+			cacheDel(g.idcache, change.FileId)
+		}
+		changes = append(changes, r.Items...)
+		if r.NextPageToken == "" {
+			return changes, r.NewStartPageToken, nil
+		}
+		pageToken = r.NextPageToken
+	}
+}
+
+// CleanTmp moves to the trash all temporary files left in the temporary
+// folder (see SetTmpFolder) by interrupted inserts that were created more than
+// 'maxAge' ago. Only files named like the temporary files created by this
+// library are considered. Nothing is done if the temporary folder does not
+// exist. Returns the number of files trashed.
+func (g *Gdrive) CleanTmp(maxAge time.Duration) (int, error) {
+	tmpDirObj, err := g.Stat(g.tmpFolder)
+	if IsObjectNotFound(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !IsDir(tmpDirObj) {
+		return 0, fmt.Errorf("CleanTmp: Temporary folder \"%s\" exists but is a file, not a directory", g.tmpFolder)
+	}
+	query := fmt.Sprintf("'%s' in parents and title contains 'temp-' and trashed = false", tmpDirObj.Id)
+	files, err := g.GdriveFilesList(query, "")
+	if err != nil {
+		return 0, fmt.Errorf("CleanTmp: Error listing temporary files: %w", err)
+	}
+
+	trashed := 0
+	cutoff := time.Now().Add(-maxAge)
+	for _, driveFile := range files {
+		if !strings.HasPrefix(driveFile.Title, "temp-") || IsDir(driveFile) {
+			continue
+		}
+		ctime, err := CreateDate(driveFile)
+		if err != nil || ctime.After(cutoff) {
+			continue
+		}
+		if _, err = g.GdriveFilesTrash(driveFile.Id); err != nil {
+			return trashed, fmt.Errorf("CleanTmp: Error trashing \"%s\": %w", driveFile.Title, err)
+		}
+		_, _, tmpPath := splitPath(g.tmpFolder + "/" + driveFile.Title)
+		cacheDel(g.filecache, tmpPath)
+		trashed++
+	}
+	return trashed, nil
+}
+
+// CopyTree copies the directory tree rooted at 'srcPath' into 'dstPath',
+// creating directories as needed and copying files on the server side (no
+// data is downloaded.) Files already present at the destination are skipped,
+// so an interrupted copy can be resumed by calling CopyTree again. A failure
+// to copy one file does not stop the others; all failures are returned
+// together in a MultiError.
+func (g *Gdrive) CopyTree(srcPath string, dstPath string) error {
+	var errs MultiError
+
+	_, _, srcPath = splitPath(srcPath)
+	_, _, dstPath = splitPath(dstPath)
+	if srcPath == "" || dstPath == "" {
+		return fmt.Errorf("CopyTree: Source and destination paths must be set")
+	}
+	src := strings.TrimPrefix(srcPath, "/")
+	dst := strings.TrimPrefix(dstPath, "/")
+	if dst == src || strings.HasPrefix(dst, src+"/") {
+		return fmt.Errorf("CopyTree: Destination \"%s\" is inside source \"%s\"", dstPath, srcPath)
+	}
+
+	// Destination directory IDs, keyed by path.
+	dstDirs := make(map[string]string)
+	err := g.Walk(srcPath, func(p string, driveFile *drive.File, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(p, "/"), src)
+		_, _, target := splitPath(dstPath + "/" + rel)
+
+		if IsDir(driveFile) {
+			dirObj, err := g.MkdirAll(target)
+			if err != nil {
+				return err
+			}
+			dstDirs[strings.TrimPrefix(target, "/")] = dirObj.Id
+			return nil
+		}
+
+		exists, err := g.Exists(target)
+		if err != nil {
+			errs = append(errs, err)
+			return nil
+		}
+		if exists {
+			return nil
+		}
+		dir, name, _ := splitPath(target)
+		parentID, ok := dstDirs[strings.TrimPrefix(dir, "/")]
+		if !ok {
+			// srcPath is a single file.
+			dirObj, err := g.MkdirAll(dir)
+			if err != nil {
+				return err
+			}
+			parentID = dirObj.Id
+		}
+		copyObj, err := g.GdriveFilesCopy(driveFile.Id, name, parentID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("CopyTree: Error copying \"%s\" to \"%s\": %w", p, target, err))
+			return nil
+		}
+		g.cacheAddPath(target, copyObj)
+		return nil
+	})
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Create returns an io.WriteCloser that uploads everything written to it to a
+// file named 'drivePath' when closed. Data is buffered in a local temporary
+// file, so the writer can be used with anything writing to an io.Writer (e.g.
+// csv.Writer or gzip.Writer) regardless of the size of the output. The
+// directory part of drivePath must exist. An existing file is replaced, as
+// with Insert. The error returned by Close reflects the outcome of the upload.
+func (g *Gdrive) Create(drivePath string) (io.WriteCloser, error) {
+	dir, _, drivePath := splitPath(drivePath)
+	if drivePath == "" {
+		return nil, fmt.Errorf("Create: empty path")
+	}
+	dirObj, err := g.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !IsDir(dirObj) {
+		return nil, fmt.Errorf("Create: \"%s\" is not a directory", dir)
+	}
+
+	tmpFile, err := ioutil.TempFile("", "godrive-")
+	if err != nil {
+		return nil, fmt.Errorf("Create: Error creating temporary file: %w", err)
+	}
+	return &uploadWriter{g: g, drivePath: drivePath, tmpFile: tmpFile}, nil
+}
+
+// uploadWriter is the io.WriteCloser returned by Create.
+type uploadWriter struct {
+	g         *Gdrive
+	drivePath string
+	tmpFile   *os.File
+	closed    bool
+}
+
+// Write writes 'p' to the local temporary file.
+func (w *uploadWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("Create: Write to closed file \"%s\"", w.drivePath)
+	}
+	return w.tmpFile.Write(p)
+}
+
+// Close uploads the data written so far to Google Drive and removes the local
+// temporary file.
+func (w *uploadWriter) Close() error {
+	if w.closed {
+		return fmt.Errorf("Create: File \"%s\" already closed", w.drivePath)
+	}
+	w.closed = true
+	defer os.Remove(w.tmpFile.Name())
+	defer w.tmpFile.Close()
+
+	if _, err := w.tmpFile.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("Create: Error rewinding temporary file: %w", err)
+	}
+	_, err := w.g.Insert(w.drivePath, w.tmpFile)
+	return err
+}
+
+// Dedupe resolves duplicate objects named 'drivePath' by keeping the most
+// recently modified one and moving all others to the trash. Returns the object
+// kept and the number of objects trashed. Note that trashing a duplicate
+// directory also trashes its contents.
+func (g *Gdrive) Dedupe(drivePath string) (kept *drive.File, trashed int, err error) {
+	_, _, drivePath = splitPath(drivePath)
+	files, err := g.StatAll(drivePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	kept, err = newestFile(files)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Dedupe: Error parsing modification date of \"%s\": %w", drivePath, err)
+	}
+
+	// Cached objects under this path may point to any of the duplicates.
+	defer g.InvalidatePath(drivePath)
+
+	for _, driveFile := range files {
+		if driveFile.Id == kept.Id {
+			continue
+		}
+		if _, err = g.GdriveFilesTrash(driveFile.Id); err != nil {
+			return kept, trashed, fmt.Errorf("Dedupe: Error trashing duplicate of \"%s\": %w", drivePath, err)
+		}
+		cacheDel(g.idcache, driveFile.Id)
+		trashed++
+	}
+	return kept, trashed, nil
+}
+
+// Delete permanently deletes the object (file or directory) pointed by
+// 'drivePath', skipping the trash. Directories are deleted with all their
+// contents. This operation cannot be undone; use Remove to move objects to
+// the trash instead.
+func (g *Gdrive) Delete(drivePath string) error {
+	_, _, drivePath = splitPath(drivePath)
+	if drivePath == "" {
+		return fmt.Errorf("Delete: empty path")
+	}
+	driveFile, err := g.Stat(drivePath)
+	if err != nil {
+		return err
+	}
+	err = g.GdriveFilesDelete(driveFile.Id)
+	if err != nil {
+		return fmt.Errorf("Delete: Error deleting \"%s\": %w", drivePath, err)
+	}
+	cacheDel(g.idcache, driveFile.Id)
+	g.InvalidatePath(drivePath)
+	return nil
+}
+
+// DiskUsage returns the total size and number of files (excluding folders)
+// in the tree rooted at 'drivePath', which may also be a single file. Native
+// Google Docs have no size and count as zero bytes.
+func (g *Gdrive) DiskUsage(drivePath string) (totalBytes int64, fileCount int, err error) {
+	err = g.Walk(drivePath, func(p string, driveFile *drive.File, err error) error {
+		if err != nil {
+			return err
+		}
+		if !IsDir(driveFile) {
+			totalBytes += driveFile.FileSize
+			fileCount++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return totalBytes, fileCount, nil
+}
+
+// Download a file from Gdrive. Returns an io.ReadCloser to gdrive file pointed by srcPath.
+// The io.ReadCloser can be used to save the file locally by the caller, who is
+// responsible for closing it.
+func (g *Gdrive) Download(srcPath string) (io.ReadCloser, error) {
+	return g.DownloadContext(context.Background(), srcPath)
+}
+
+// DownloadContext works like Download, but the metadata lookup and the
+// download request itself are bound to 'ctx'. Cancelling the context aborts
+// the transfer.
+func (g *Gdrive) DownloadContext(ctx context.Context, srcPath string) (io.ReadCloser, error) {
 	// Sanitize
 	_, _, srcPath = splitPath(srcPath)
 	if srcPath == "" {
 		return nil, fmt.Errorf("Download: empty source path")
 	}
 
-	srcFileObj, err := g.Stat(srcPath)
+	srcFileObj, err := g.StatContext(ctx, srcPath)
+	if err != nil {
+		return nil, err
+	}
+	if !CanDownload(srcFileObj) {
+		return nil, notDownloadable("Download", srcPath, srcFileObj)
+	}
+
+	reader, err := g.downloadFile(ctx, srcPath, srcFileObj)
+	if err != nil {
+		return nil, fmt.Errorf("Download: Error downloading \"%s\": %w", srcPath, err)
+	}
+	return reader, nil
+}
+
+// downloadFile returns an io.ReadCloser to the contents of 'driveFile'
+// (pointed by 'drivePath'). Download URLs expire after some time, so if the
+// download fails with an authorization error the metadata is fetched again
+// from Google Drive (bypassing the cache) and the download retried once.
+func (g *Gdrive) downloadFile(ctx context.Context, drivePath string, driveFile *drive.File) (io.ReadCloser, error) {
+	reader, err := g.fetchURL(ctx, driveFile.DownloadUrl)
+	if !isAuthError(err) {
+		return reader, err
+	}
+
+	driveFile, err = g.GdriveFilesGetContext(ctx, driveFile.Id)
+	if err != nil {
+		return nil, err
+	}
+	_, _, drivePath = splitPath(drivePath)
+	cacheAdd(g.filecache, drivePath, driveFile)
+	return g.fetchURL(ctx, driveFile.DownloadUrl)
+}
+
+// DownloadURL returns the (authenticated) download URL for the file pointed
+// by 'drivePath'. Since these URLs expire, the metadata is always fetched
+// fresh from Google Drive instead of the cache.
+//
+// Note that the URL requires the caller's authorization token and is only
+// valid for a short time. It is meant for immediate server side fetches and
+// is not suitable to be handed to unauthenticated clients.
+func (g *Gdrive) DownloadURL(drivePath string) (string, error) {
+	driveFile, err := g.Stat(drivePath)
+	if err != nil {
+		return "", err
+	}
+	driveFile, err = g.GdriveFilesGet(driveFile.Id)
+	if err != nil {
+		return "", err
+	}
+	if !CanDownload(driveFile) {
+		return "", notDownloadable("DownloadURL", drivePath, driveFile)
+	}
+	return driveFile.DownloadUrl, nil
+}
+
+// DownloadToFile downloads a file named 'srcPath' into 'localFile'. localFile will be
+// overwritten if it exists. The file is first downloaded into a temporary file
+// in the same directory and then atomically moved into the destination file. Native Google documents
+// are exported to a default format (PDF for Docs, xlsx for Sheets and pptx for
+// Slides). Returns the number of bytes downloaded.
+func (g *Gdrive) DownloadToFile(srcPath string, localFile string) (int64, error) {
+	return g.downloadToFile(srcPath, localFile, "", nil)
+}
+
+// DownloadToFileAs works like DownloadToFile, but exports the native Google
+// document pointed by 'srcPath' to the format given by 'mimeType'.
+func (g *Gdrive) DownloadToFileAs(srcPath string, localFile string, mimeType string) (int64, error) {
+	if mimeType == "" {
+		return 0, fmt.Errorf("DownloadToFileAs: empty MIME type")
+	}
+	return g.downloadToFile(srcPath, localFile, mimeType, nil)
+}
+
+// DownloadToFileInPlace works like DownloadToFile, but writes directly into
+// 'localFile' without using a temporary file. This avoids the need for twice
+// the free space, at the cost of leaving a partial (or truncated) localFile
+// behind if the download fails.
+func (g *Gdrive) DownloadToFileInPlace(srcPath string, localFile string) (int64, error) {
+	if localFile == "" {
+		return 0, fmt.Errorf("DownloadToFileInPlace: empty local file")
+	}
+	w, err := os.Create(localFile)
+	if err != nil {
+		return 0, err
+	}
+	written, err := g.DownloadToWriter(srcPath, w)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return written, err
+}
+
+// DownloadToFileWithProgress works like DownloadToFile, calling 'cb'
+// periodically with the cumulative number of bytes received. A nil callback
+// disables progress reporting.
+func (g *Gdrive) DownloadToFileWithProgress(srcPath string, localFile string, cb func(bytesReceived int64)) (int64, error) {
+	return g.downloadToFile(srcPath, localFile, "", cb)
+}
+
+// downloadToFile implements DownloadToFile, DownloadToFileAs and
+// DownloadToFileWithProgress. If 'mimeType' is not empty, the source is
+// exported to that format; otherwise native Google documents are exported to
+// their default format. If 'cb' is not nil, it will be called with the number
+// of bytes received so far while the download progresses.
+func (g *Gdrive) downloadToFile(srcPath string, localFile string, mimeType string, cb func(int64)) (int64, error) {
+	// Sanitize
+	_, _, srcPath = splitPath(srcPath)
+	if srcPath == "" {
+		return 0, fmt.Errorf("DownloadToFile: empty source path")
+	}
+	if localFile == "" {
+		return 0, fmt.Errorf("DownloadToFile: empty local file")
+	}
+	// If the file exists, it must be a regular file. Its permissions are
+	// preserved.
+	perm := os.FileMode(0644)
+	fi, err := os.Stat(localFile)
+	if err == nil {
+		if !fi.Mode().IsRegular() {
+			return 0, fmt.Errorf("Download: Local file \"%s\" exists and is not a regular file", localFile)
+		}
+		perm = fi.Mode().Perm()
+	}
+	dir := filepath.Dir(localFile)
+
+	reader, srcFileObj, err := g.openDownload("DownloadToFile", srcPath, mimeType)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	// Make sure the file fits in the destination filesystem before starting.
+	// The size of exported documents is unknown.
+	if srcFileObj.FileSize > 0 {
+		free, err := diskFree(dir)
+		if err != nil {
+			return 0, fmt.Errorf("DownloadToFile: Unable to determine free space for \"%s\": %w", localFile, err)
+		}
+		if free >= 0 && free < srcFileObj.FileSize {
+			return 0, fmt.Errorf("DownloadToFile: Insufficient space to download \"%s\" (%d bytes needed, %d available)", srcPath, srcFileObj.FileSize, free)
+		}
+	}
+
+	// Create a temporary file in the same directory as the destination and
+	// write to it, renaming at the end. This keeps the rename atomic.
+	tmpWriter, err := ioutil.TempFile(dir, ".godrive-")
+	if err != nil {
+		return 0, err
+	}
+	tmpFile := tmpWriter.Name()
+	defer os.Remove(tmpFile)
+	defer tmpWriter.Close()
+
+	var src io.Reader = reader
+	if cb != nil {
+		src = &progressReader{reader: reader, cb: cb}
+	}
+	written, err := io.Copy(tmpWriter, src)
+	if err != nil {
+		return 0, err
+	}
+	if err = tmpWriter.Chmod(perm); err != nil {
+		return 0, err
+	}
+
+	err = os.Rename(tmpFile, localFile)
+	if err != nil {
+		return 0, err
+	}
+
+	return written, nil
+}
+
+// DownloadToWriter downloads a file named 'srcPath' and writes its contents
+// to 'w', without using any temporary files. Native Google documents are
+// exported to their default format, as with DownloadToFile. Returns the number
+// of bytes written.
+func (g *Gdrive) DownloadToWriter(srcPath string, w io.Writer) (int64, error) {
+	_, _, srcPath = splitPath(srcPath)
+	if srcPath == "" {
+		return 0, fmt.Errorf("DownloadToWriter: empty source path")
+	}
+	reader, _, err := g.openDownload("DownloadToWriter", srcPath, "")
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+	return io.Copy(w, reader)
+}
+
+// openDownload returns an io.ReadCloser to the contents of the file pointed
+// by 'srcPath' and its *drive.File object. If 'mimeType' is not empty, the
+// source is exported to that format; otherwise native Google documents are
+// exported to their default format. 'op' is used as the prefix of error
+// messages.
+func (g *Gdrive) openDownload(op string, srcPath string, mimeType string) (io.ReadCloser, *drive.File, error) {
+	srcFileObj, err := g.Stat(srcPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if mimeType == "" && !CanDownload(srcFileObj) {
+		mimeType = defaultExportFormats[srcFileObj.MimeType]
+		if mimeType == "" {
+			return nil, nil, notDownloadable(op, srcPath, srcFileObj)
+		}
+	}
+
+	var reader io.ReadCloser
+	if mimeType != "" {
+		exportURL, ok := srcFileObj.ExportLinks[mimeType]
+		if !ok {
+			return nil, nil, exportError(srcPath, mimeType, srcFileObj)
+		}
+		reader, err = g.fetchURL(context.Background(), exportURL)
+	} else {
+		reader, err = g.downloadFile(context.Background(), srcPath, srcFileObj)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: Error downloading \"%s\": %w", op, srcPath, err)
+	}
+	return reader, srcFileObj, nil
+}
+
+// EmptyTrash permanently deletes all objects in the Google Drive trash. This
+// operation cannot be undone.
+func (g *Gdrive) EmptyTrash() error {
+	err := g.GdriveFilesEmptyTrash()
+	if err != nil {
+		return fmt.Errorf("EmptyTrash: Error emptying trash: %w", err)
+	}
+	return nil
+}
+
+// Exists returns true if the object pointed by 'drivePath' exists. A missing
+// object returns (false, nil). Any other error returned by Stat (including the
+// presence of duplicates in the path) is returned to the caller.
+func (g *Gdrive) Exists(drivePath string) (bool, error) {
+	_, err := g.Stat(drivePath)
+	if err != nil {
+		if IsObjectNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Export exports the native Google document (Docs, Sheets, Slides, etc.)
+// pointed by 'srcPath' to the format given by 'mimeType' (e.g.
+// "application/pdf" or "text/csv") and returns an io.ReadCloser to the
+// exported contents. The caller is responsible for closing it. An error
+// listing the available formats is returned if the requested format is not
+// offered for that document.
+func (g *Gdrive) Export(srcPath string, mimeType string) (io.ReadCloser, error) {
+	// Sanitize
+	_, _, srcPath = splitPath(srcPath)
+	if srcPath == "" {
+		return nil, fmt.Errorf("Export: empty source path")
+	}
+
+	srcFileObj, err := g.Stat(srcPath)
+	if err != nil {
+		return nil, err
+	}
+	url, ok := srcFileObj.ExportLinks[mimeType]
+	if !ok {
+		return nil, exportError(srcPath, mimeType, srcFileObj)
+	}
+
+	reader, err := g.fetchURL(context.Background(), url)
+	if err != nil {
+		return nil, fmt.Errorf("Export: Error exporting \"%s\" as \"%s\": %w", srcPath, mimeType, err)
+	}
+	return reader, nil
+}
+
+// FlushCache removes all objects from the cache, forcing subsequent
+// operations to fetch fresh information from Google Drive. This is useful
+// after changes made to Google Drive by other clients.
+func (g *Gdrive) FlushCache() {
+	g.filecache = &map[string]*objCache{}
+	g.childcache = &map[string]*objCache{}
+	g.idcache = &map[string]*objCache{}
+	g.negcache = &map[string]*objCache{}
+}
+
+// GetDescription returns the description of the file/directory specified by
+// 'drivePath', or a blank string if it has none.
+func (g *Gdrive) GetDescription(drivePath string) (string, error) {
+	driveFile, err := g.Stat(drivePath)
+	if err != nil {
+		return "", err
+	}
+	return driveFile.Description, nil
+}
+
+// GetProperties returns the custom properties (key/value pairs) of the
+// file/directory specified by 'drivePath', both private and public. If the
+// same key exists with both visibilities, the private value is returned.
+func (g *Gdrive) GetProperties(drivePath string) (map[string]string, error) {
+	driveFile, err := g.Stat(drivePath)
+	if err != nil {
+		return nil, err
+	}
+	props, err := g.GdrivePropertiesList(driveFile.Id)
+	if err != nil {
+		return nil, fmt.Errorf("GetProperties: Error listing properties of \"%s\": %w", drivePath, err)
+	}
+
+	ret := make(map[string]string, len(props))
+	for _, prop := range props {
+		if _, ok := ret[prop.Key]; ok && prop.Visibility != "PRIVATE" {
+			continue
+		}
+		ret[prop.Key] = prop.Value
+	}
+	return ret, nil
+}
+
+// Glob returns the full paths (starting with "/") of all objects matching
+// 'pattern' (sorted), or nil if there is no match. This works like filepath.Glob and the syntax of
+// each path element is the same as in path.Match. Elements without wildcards
+// are resolved directly with Stat, while elements with wildcards are expanded
+// by listing their parent directory. The only possible returned error is
+// path.ErrBadPattern, or an error coming from Google Drive.
+func (g *Gdrive) Glob(pattern string) ([]string, error) {
+	var elems []string
+
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	for _, e := range strings.Split(pattern, "/") {
+		if e != "" {
+			elems = append(elems, e)
+		}
+	}
+	if len(elems) == 0 {
+		return nil, nil
+	}
+
+	// Blank represents the root directory.
+	matches := []string{""}
+
+	for idx, elem := range elems {
+		var next []string
+
+		// Only the last element can match files.
+		last := (idx == len(elems)-1)
+
+		for _, dir := range matches {
+			if !hasMeta(elem) {
+				driveFile, err := g.Stat(dir + "/" + elem)
+				if err != nil {
+					if IsObjectNotFound(err) {
+						continue
+					}
+					return nil, err
+				}
+				if last || IsDir(driveFile) {
+					next = append(next, dir+"/"+elem)
+				}
+				continue
+			}
+
+			dirPath := dir
+			if dirPath == "" {
+				dirPath = "/"
+			}
+			files, err := g.ListDir(dirPath, "")
+			if err != nil {
+				return nil, err
+			}
+			for _, driveFile := range files {
+				if !last && !IsDir(driveFile) {
+					continue
+				}
+				if ok, _ := path.Match(elem, driveFile.Title); ok {
+					next = append(next, dir+"/"+driveFile.Title)
+				}
+			}
+		}
+		matches = next
+	}
+
+	if len(matches) == 0 {
+		return nil, nil
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// PathEntry pairs an object with its full path (starting with "/"), as
+// returned by GlobEntries, ListDirEntries and WalkEntries.
+type PathEntry struct {
+	Path string
+	File *drive.File
+}
+
+// GlobEntries works like Glob, but returns a PathEntry for each object
+// matching 'pattern'.
+func (g *Gdrive) GlobEntries(pattern string) ([]PathEntry, error) {
+	matches, err := g.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]PathEntry, 0, len(matches))
+	for _, match := range matches {
+		driveFile, err := g.Stat(match)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, PathEntry{Path: "/" + strings.TrimPrefix(match, "/"), File: driveFile})
+	}
+	return ret, nil
+}
+
+// Insert inserts a file named 'dstPath' with the contents coming from
+// 'reader'. The method calls the 'insert' method with the inplace option set
+// to false, causing the file to be writen to a temporary location and then
+// renamed to its final place. This method is safer (but slower) than the
+// InsertInPlace method.
+//
+// Returns *drive.File pointing to the file in its final location.
+func (g *Gdrive) Insert(dstPath string, reader io.Reader) (*drive.File, error) {
+	return g.insert(dstPath, reader, InsertOptions{})
+}
+
+// InsertCounting works like Insert, but also returns the number of bytes
+// read from 'reader' and sent to Google Drive.
+func (g *Gdrive) InsertCounting(dstPath string, reader io.Reader) (*drive.File, int64, error) {
+	counter := &progressReader{reader: reader}
+	driveFile, err := g.insert(dstPath, counter, InsertOptions{})
+	if err != nil {
+		return nil, counter.total, err
+	}
+	return driveFile, counter.total, nil
+}
+
+// InsertFile inserts the contents of the local file 'localFile' into a file
+// named 'dstPath' and sets the modification date of the destination to that of
+// the local file. The MIME type of the destination is detected from the
+// extension of the local file or, failing that, from its contents. Symbolic
+// links are followed (the contents of the target are uploaded), unless
+// disabled with SetFollowSymlinks(false), in which case an error is returned.
+//
+// Returns *drive.File pointing to the file in its final location.
+func (g *Gdrive) InsertFile(dstPath string, localFile string) (*drive.File, error) {
+	return g.insertFile(dstPath, localFile, "")
+}
+
+// InsertFileAs works like InsertFile, but sets the MIME type of the
+// destination to 'mimeType' instead of detecting it.
+func (g *Gdrive) InsertFileAs(dstPath string, localFile string, mimeType string) (*drive.File, error) {
+	if mimeType == "" {
+		return nil, fmt.Errorf("InsertFileAs: empty MIME type")
+	}
+	return g.insertFile(dstPath, localFile, mimeType)
+}
+
+// insertFile implements InsertFile and InsertFileAs. The MIME type is
+// detected if 'mimeType' is blank.
+func (g *Gdrive) insertFile(dstPath string, localFile string, mimeType string) (*drive.File, error) {
+	fi, err := os.Lstat(localFile)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 && !g.followSymlinks {
+		return nil, fmt.Errorf("InsertFile: \"%s\" is a symbolic link and following symlinks is disabled", localFile)
+	}
+
+	// os.Stat follows symbolic links
+	fi, err = os.Stat(localFile)
+	if err != nil {
+		return nil, fmt.Errorf("InsertFile: Unable to stat \"%s\" (broken symlink?): %w", localFile, err)
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("InsertFile: \"%s\" is not a regular file", localFile)
+	}
+
+	reader, err := os.Open(localFile)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	if mimeType == "" {
+		mimeType, err = detectMimeType(reader)
+		if err != nil {
+			return nil, fmt.Errorf("InsertFile: Unable to detect MIME type of \"%s\": %w", localFile, err)
+		}
+	}
+
+	// Setting the modification date on insert saves one request.
+	return g.insert(dstPath, reader, InsertOptions{MimeType: mimeType, ModifiedDate: fi.ModTime()})
+}
+
+// InsertInPlace inserts a file named 'dstPath' with the contents coming from
+// reader. The method calls the 'insert' method with the inplace option set to
+// true, causing the file to be written directly to its final destination. This
+// is faster but (theoretically) less safe than using "Insert".
+//
+// Returns *drive.File: pointing to the file in its final location.
+func (g *Gdrive) InsertInPlace(dstPath string, reader io.Reader) (*drive.File, error) {
+	return g.insert(dstPath, reader, InsertOptions{InPlace: true})
+}
+
+// InsertOptions holds optional parameters for InsertWithOptions.
+type InsertOptions struct {
+	// Write the file directly to its final location (see InsertInPlace)
+	InPlace bool
+
+	// Custom properties (key/value pairs) set on the file when it is
+	// created, so it never exists without them. These properties are only
+	// visible to the application that created them.
+	Properties map[string]string
+
+	// MIME type of the file. If blank, Google Drive will try to guess it.
+	MimeType string
+
+	// Convert the file to the corresponding native Google document format
+	// (e.g. xlsx files to Google Sheets.) By default, files are stored
+	// verbatim.
+	Convert bool
+
+	// Modification date of the file. If zero, the upload time is used.
+	ModifiedDate time.Time
+}
+
+// InsertWithMeta inserts a file named 'dstPath' with the contents coming from
+// 'reader', setting its modification date to 'modTime' and its MIME type to
+// 'mimeType' (detected by Google Drive if blank) in the same request. This is
+// useful to preserve timestamps when the source is not a local file.
+//
+// Returns *drive.File pointing to the file in its final location.
+func (g *Gdrive) InsertWithMeta(dstPath string, reader io.Reader, modTime time.Time, mimeType string) (*drive.File, error) {
+	return g.insert(dstPath, reader, InsertOptions{ModifiedDate: modTime, MimeType: mimeType})
+}
+
+// InsertWithOptions inserts a file named 'dstPath' with the contents coming
+// from 'reader', according to the options in 'opts'.
+//
+// Returns *drive.File pointing to the file in its final location.
+func (g *Gdrive) InsertWithOptions(dstPath string, reader io.Reader, opts InsertOptions) (*drive.File, error) {
+	return g.insert(dstPath, reader, opts)
+}
+
+// InsertWithProgress works like Insert, calling 'cb' periodically with the
+// cumulative number of bytes sent. A nil callback disables progress
+// reporting.
+func (g *Gdrive) InsertWithProgress(dstPath string, reader io.Reader, cb func(bytesSent int64)) (*drive.File, error) {
+	if cb != nil {
+		reader = &progressReader{reader: reader, cb: cb}
+	}
+	return g.insert(dstPath, reader, InsertOptions{})
+}
+
+// insert inserts a file named 'dstPath' with the contents coming from reader.
+// If opts.InPlace is set to false, this method first inserts the file under
+// the temporary folder (see SetTmpFolder) and then moves it to its final
+// location. If opts.InPlace is set to true, the the methdo removes the
+// destination file if it exists and uploads directly (this saves time). The
+// temporary folder will be automatically created, if needed.
+//
+// Returns *drive.File: pointing to the file in its final location.
+func (g *Gdrive) insert(dstPath string, reader io.Reader, opts InsertOptions) (*drive.File, error) {
+	var (
+		outDir     string
+		outFile    string
+		outPath    string
+		parent     *drive.File
+		outFileObj *drive.File
+		err        error
+	)
+
+	if g.dryRun {
+		_, outFile, dstPath = splitPath(dstPath)
+		g.log.Verbosef(1, "Dry run: Insert \"%s\"\n", dstPath)
+		return &drive.File{Title: outFile, MimeType: opts.MimeType}, nil
+	}
+
+	if opts.InPlace {
+		outDir, outFile, dstPath = splitPath(dstPath)
+		outPath = dstPath
+		parent, err = g.Stat(outDir)
+		if err != nil {
+			return nil, fmt.Errorf("insert: Unable to stat destination directory: \"%s\": %w", outDir, err)
+		}
+	} else {
+		// We upload to the temporary folder so it must always exist
+		parent, err = g.tmpDir()
+		if err != nil {
+			return nil, err
+		}
+
+		outFile, err = tmpName()
+		if err != nil {
+			return nil, fmt.Errorf("insert: Error generating temporary file name: %w", err)
+		}
+		_, _, outPath = splitPath(g.tmpFolder + "/" + outFile)
+	}
+
+	// Delete output object if it already exists (file or directory)
+	outFileObj, err = g.Stat(outPath)
+	if err != nil && !IsObjectNotFound(err) {
+		return nil, err
+	}
+	if !IsObjectNotFound(err) {
+		_, err = g.GdriveFilesTrash(outFileObj.Id)
+		if err != nil {
+			return nil, fmt.Errorf("insert: Error removing (existing) destination file \"%s\": %w", outPath, err)
+		}
+	}
+
+	// Insert file
+	driveFile := &drive.File{
+		Title:      outFile,
+		MimeType:   opts.MimeType,
+		Parents:    []*drive.ParentReference{{Id: parent.Id}},
+		Properties: driveProperties(opts.Properties),
+	}
+	if !opts.ModifiedDate.IsZero() {
+		driveFile.ModifiedDate = driveDate(opts.ModifiedDate)
+	}
+	outFileObj, err = g.gdriveFilesInsert(reader, driveFile, opts.Convert)
+	if err != nil {
+		return nil, fmt.Errorf("insert: Error inserting file \"%s\": %w", outPath, err)
+	}
+
+	// Move file to definitive location if needed. Don't leave the
+	// temporary file behind if that fails.
+	if !opts.InPlace {
+		tmpFileObj := outFileObj
+		outFileObj, err = g.Move(outPath, dstPath)
+		if err != nil {
+			if _, terr := g.GdriveFilesTrash(tmpFileObj.Id); terr == nil {
+				cacheDel(g.filecache, outPath)
+			}
+			return nil, err
+		}
+		outPath = dstPath
+	}
+
+	g.cacheAddPath(outPath, outFileObj)
+	return outFileObj, nil
+}
+
+// InvalidatePath removes 'drivePath' and every object below it from the
+// cache, including the by-ID entries of those objects. Use this to force a
+// fresh lookup after known external changes without flushing the whole cache.
+func (g *Gdrive) InvalidatePath(drivePath string) {
+	_, _, drivePath = splitPath(drivePath)
+	if drivePath == "" {
+		g.FlushCache()
+		return
+	}
+	for _, obj := range cacheDelPrefix(g.filecache, drivePath) {
+		cacheDel(g.idcache, obj.(*drive.File).Id)
+	}
+	for _, obj := range cacheDelPrefix(g.childcache, drivePath) {
+		cacheDel(g.idcache, obj.(*drive.ChildReference).Id)
+	}
+	cacheDelPrefix(g.negcache, drivePath)
+}
+
+// Link makes the object pointed by 'existingPath' also appear as 'newPath',
+// by adding the directory of newPath as an additional parent of the object.
+// Both paths refer to the same object (changes to one are visible in the
+// other.) Since objects have a single name, the last element of newPath must
+// be the same as that of existingPath.
+func (g *Gdrive) Link(existingPath string, newPath string) (*drive.File, error) {
+	_, srcFile, existingPath := splitPath(existingPath)
+	dstDir, dstFile, newPath := splitPath(newPath)
+	if existingPath == "" || newPath == "" {
+		return nil, fmt.Errorf("Link: Both existing and new paths must be set")
+	}
+	if srcFile != dstFile {
+		return nil, fmt.Errorf("Link: Name of \"%s\" must match the name of \"%s\"", newPath, existingPath)
+	}
+
+	srcObj, err := g.Stat(existingPath)
+	if err != nil {
+		return nil, err
+	}
+	dstDirObj, err := g.Stat(dstDir)
+	if err != nil {
+		return nil, err
+	}
+	if !IsDir(dstDirObj) {
+		return nil, fmt.Errorf("Link: \"%s\" is not a directory", dstDir)
+	}
+	_, err = g.Stat(newPath)
+	if err == nil {
+		return nil, fmt.Errorf("Link: \"%s\" already exists", newPath)
+	}
+	if !IsObjectNotFound(err) {
+		return nil, err
+	}
+
+	driveFile, err := g.GdriveFilesPatch(srcObj.Id, "", "", []string{dstDirObj.Id}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Link: Error linking \"%s\" to \"%s\": %w", existingPath, newPath, err)
+	}
+	cacheAdd(g.filecache, existingPath, driveFile)
+	g.cacheAddPath(newPath, driveFile)
+	return driveFile, nil
+}
+
+// ListDir returns a slice of *drive.File objects under 'drivePath' matching 'query'
+// (in Google Drive query format.) If query is blank, it defaults to 'trashed =
+// false'. The full metadata of all children is fetched in paged batches, using
+// a single request per page.
+func (g *Gdrive) ListDir(drivePath string, query string) ([]*drive.File, error) {
+	return g.ListDirOrdered(drivePath, query, "")
+}
+
+// ListDirEntries works like ListDir, but returns a PathEntry for each object
+// found.
+func (g *Gdrive) ListDirEntries(drivePath string, query string) ([]PathEntry, error) {
+	files, err := g.ListDir(drivePath, query)
+	if err != nil {
+		return nil, err
+	}
+	_, _, drivePath = splitPath(drivePath)
+	ret := make([]PathEntry, len(files))
+	for idx, driveFile := range files {
+		ret[idx] = PathEntry{Path: path.Join("/", drivePath, driveFile.Title), File: driveFile}
+	}
+	return ret, nil
+}
+
+// ListDirFunc works like ListDir, but calls 'fn' for each object under
+// 'drivePath' as pages of results arrive from Google Drive, instead of
+// returning them all at once. This keeps memory usage low on very large
+// directories. Listing stops and the error is returned if 'fn' returns an
+// error. See SetPageSize to control the number of objects per page.
+func (g *Gdrive) ListDirFunc(drivePath string, query string, fn func(*drive.File) error) error {
+	driveDir, err := g.Stat(drivePath)
+	if err != nil {
+		return err
+	}
+
+	if query == "" {
+		query = "trashed = false"
+	}
+	query = fmt.Sprintf("'%s' in parents and (%s)", driveDir.Id, query)
+	return g.GdriveFilesListFunc(query, "", fn)
+}
+
+// Entry is a lightweight description of an object, as returned by ListDirBrief.
+type Entry struct {
+	Name  string
+	ID    string
+	IsDir bool
+}
+
+// ListDirBrief returns a slice of Entry objects describing the (non trashed)
+// objects directly under 'drivePath'. Only the id, title and MIME type of each
+// object are fetched, in a single paged listing, making this much cheaper
+// than ListDir when the full metadata is not needed.
+func (g *Gdrive) ListDirBrief(drivePath string) ([]Entry, error) {
+	driveDir, err := g.Stat(drivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf("'%s' in parents and trashed = false", driveDir.Id)
+	files, err := g.GdriveFilesList(query, "id,title,mimeType")
+	if err != nil {
+		return nil, fmt.Errorf("ListDirBrief: Error listing path \"%s\": %w", drivePath, err)
+	}
+
+	ret := make([]Entry, len(files))
+	for idx, driveFile := range files {
+		ret[idx] = Entry{Name: driveFile.Title, ID: driveFile.Id, IsDir: IsDir(driveFile)}
+	}
+	return ret, nil
+}
+
+// ListDirConcurrent works like ListDir, but lists the children of 'drivePath'
+// and fetches their metadata using up to 'workers' concurrent requests. The
+// returned slice preserves the order of the children listing. All outstanding
+// requests are aborted on the first error.
+func (g *Gdrive) ListDirConcurrent(drivePath string, query string, workers int) ([]*drive.File, error) {
+	var (
+		firstErr error
+		once     sync.Once
+		wg       sync.WaitGroup
+	)
+
+	if workers < 1 {
+		return nil, fmt.Errorf("ListDirConcurrent: Number of workers must be at least 1")
+	}
+	driveDir, err := g.Stat(drivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if query == "" {
+		query = "trashed = false"
+	}
+	children, err := g.GdriveChildrenList(driveDir.Id, query)
+	if err != nil {
+		return nil, fmt.Errorf("ListDirConcurrent: Error retrieving ChildrenList for path \"%s\": %w", drivePath, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ret := make([]*drive.File, len(children))
+	sem := make(chan struct{}, workers)
+	for idx, child := range children {
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(idx int, id string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			driveFile, err := g.GdriveFilesGetContext(ctx, id)
+			if err != nil {
+				once.Do(func() {
+					firstErr = fmt.Errorf("ListDirConcurrent: Error fetching file metadata for path \"%s\": %w", drivePath, err)
+					cancel()
+				})
+				return
+			}
+			ret[idx] = driveFile
+		}(idx, child.Id)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return ret, nil
+}
+
+// ListDirOrdered works like ListDir, but returns the objects sorted by
+// Google Drive according to 'orderBy', a comma separated list of sort keys
+// (e.g. "title" or "modifiedDate desc"). A blank orderBy leaves the order
+// unspecified.
+func (g *Gdrive) ListDirOrdered(drivePath string, query string, orderBy string) ([]*drive.File, error) {
+	var ret []*drive.File
+
+	driveDir, err := g.Stat(drivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if query == "" {
+		query = "trashed = false"
+	}
+	query = fmt.Sprintf("'%s' in parents and (%s)", driveDir.Id, query)
+	err = g.gdriveFilesListFunc(context.Background(), query, "", orderBy, func(driveFile *drive.File) error {
+		ret = append(ret, driveFile)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ListDir: Error listing path \"%s\": %w", drivePath, err)
+	}
+	return ret, nil
+}
+
+// ListDirRecursive works like ListDir, but returns all objects matching
+// 'query' anywhere below 'drivePath', descending into all subdirectories
+// (whether or not they match the query.) A parallel slice holds the path of
+// each object, relative to drivePath. Objects are added to the cache.
+func (g *Gdrive) ListDirRecursive(drivePath string, query string) ([]*drive.File, []string, error) {
+	var (
+		files []*drive.File
+		paths []string
+	)
+
+	_, _, drivePath = splitPath(drivePath)
+	driveDir, err := g.Stat(drivePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if query == "" {
+		query = "trashed = false"
+	}
+
+	type pendingDir struct {
+		id      string
+		relPath string
+	}
+	dirQuery := fmt.Sprintf("mimeType = '%s' and trashed = false", mimeTypeFolder)
+	pending := []pendingDir{{id: driveDir.Id}}
+	for len(pending) > 0 {
+		dir := pending[0]
+		pending = pending[1:]
+
+		matches, err := g.GdriveFilesList(fmt.Sprintf("'%s' in parents and (%s)", dir.id, query), "")
+		if err != nil {
+			return nil, nil, fmt.Errorf("ListDirRecursive: Error listing path \"%s\": %w", path.Join(drivePath, dir.relPath), err)
+		}
+		for _, driveFile := range matches {
+			relPath := path.Join(dir.relPath, driveFile.Title)
+			_, _, fullPath := splitPath(drivePath + "/" + relPath)
+			cacheAdd(g.filecache, fullPath, driveFile)
+			files = append(files, driveFile)
+			paths = append(paths, relPath)
+		}
+
+		subdirs, err := g.GdriveFilesList(fmt.Sprintf("'%s' in parents and %s", dir.id, dirQuery), "id,title")
+		if err != nil {
+			return nil, nil, fmt.Errorf("ListDirRecursive: Error listing path \"%s\": %w", path.Join(drivePath, dir.relPath), err)
+		}
+		for _, subdir := range subdirs {
+			pending = append(pending, pendingDir{id: subdir.Id, relPath: path.Join(dir.relPath, subdir.Title)})
+		}
+	}
+	return files, paths, nil
+}
+
+// ListFiles returns a slice of *drive.File objects for all (non trashed)
+// objects under 'drivePath' that are not directories. Directories are
+// filtered out by Google Drive itself.
+func (g *Gdrive) ListFiles(drivePath string) ([]*drive.File, error) {
+	return g.ListDir(drivePath, fmt.Sprintf("mimeType != '%s' and trashed = false", mimeTypeFolder))
+}
+
+// ListStarred returns a slice of *drive.File objects for all (non trashed)
+// starred objects, anywhere in Google Drive.
+func (g *Gdrive) ListStarred() ([]*drive.File, error) {
+	return g.GdriveFilesList("starred = true and trashed = false", "")
+}
+
+// ListSubdirs returns a slice of *drive.File objects for all (non trashed)
+// directories under 'drivePath'. Other objects are filtered out by Google
+// Drive itself.
+func (g *Gdrive) ListSubdirs(drivePath string) ([]*drive.File, error) {
+	return g.ListDir(drivePath, fmt.Sprintf("mimeType = '%s' and trashed = false", mimeTypeFolder))
+}
+
+// ListTrash returns a slice of *drive.File objects for all of the user's
+// objects currently in the trash.
+func (g *Gdrive) ListTrash() ([]*drive.File, error) {
+	return g.GdriveFilesList("trashed = true", "")
+}
+
+// ManifestEntry describes a single file in a manifest, as returned by
+// Manifest.
+type ManifestEntry struct {
+	Path     string    `json:"path"`
+	ID       string    `json:"id"`
+	Md5      string    `json:"md5"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// Manifest returns a ManifestEntry for every file (directories are not
+// included) in the tree rooted at 'driveDir', sorted by path. The result is
+// suitable for serialization and comparison between runs. Native Google Docs
+// have no checksum or size and are reported with blank/zero values.
+func (g *Gdrive) Manifest(driveDir string) ([]ManifestEntry, error) {
+	var ret []ManifestEntry
+
+	err := g.Walk(driveDir, func(drivePath string, driveFile *drive.File, err error) error {
+		if err != nil {
+			return err
+		}
+		if IsDir(driveFile) {
+			return nil
+		}
+		modified, err := ModifiedDate(driveFile)
+		if err != nil {
+			return fmt.Errorf("Manifest: Invalid modification date for \"%s\": %w", drivePath, err)
+		}
+		ret = append(ret, ManifestEntry{
+			Path:     drivePath,
+			ID:       driveFile.Id,
+			Md5:      driveFile.Md5Checksum,
+			Size:     driveFile.FileSize,
+			Modified: modified,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Path < ret[j].Path })
+	return ret, nil
+}
+
+// MergeDir moves every (non trashed) object directly under 'srcDir' into
+// 'dstDir' by re-parenting each object in place, without resolving paths.
+// Requests are issued concurrently (up to mergeDirWorkers at a time.) Objects
+// with a name already present in 'dstDir' are not moved (to avoid creating
+// duplicates) and are reported as errors. A failure to move one object does
+// not stop the others; all errors are returned together in a MultiError.
+// The (possibly empty) 'srcDir' is left in place; see MergeDirAndTrash.
+func (g *Gdrive) MergeDir(srcDir string, dstDir string) error {
+	return g.mergeDir(srcDir, dstDir, false)
+}
+
+// MergeDirAndTrash works like MergeDir, but moves the now empty 'srcDir' to
+// the trash at the end if all objects were moved.
+func (g *Gdrive) MergeDirAndTrash(srcDir string, dstDir string) error {
+	return g.mergeDir(srcDir, dstDir, true)
+}
+
+// mergeDir implements MergeDir and MergeDirAndTrash, moving 'srcDir' to the
+// trash at the end if 'trashSrc' is true.
+func (g *Gdrive) mergeDir(srcDir string, dstDir string, trashSrc bool) error {
+	var (
+		errs MultiError
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+	)
+
+	// Sanitize
+	_, _, srcDir = splitPath(srcDir)
+	_, _, dstDir = splitPath(dstDir)
+	if srcDir == "" || dstDir == "" {
+		return fmt.Errorf("MergeDir: Source and destination paths must be set")
+	}
+
+	srcObj, err := g.Stat(srcDir)
+	if err != nil {
+		return err
+	}
+	dstObj, err := g.Stat(dstDir)
+	if err != nil {
+		return err
+	}
+	if !IsDir(srcObj) || !IsDir(dstObj) {
+		return fmt.Errorf("MergeDir: Both \"%s\" and \"%s\" must be directories", srcDir, dstDir)
+	}
+	if srcObj.Id == dstObj.Id {
+		return fmt.Errorf("MergeDir: Source and destination are the same directory")
+	}
+
+	dstEntries, err := g.ListDirBrief(dstDir)
+	if err != nil {
+		return err
+	}
+	dstNames := make(map[string]bool, len(dstEntries))
+	for _, e := range dstEntries {
+		dstNames[e.Name] = true
+	}
+	srcEntries, err := g.ListDirBrief(srcDir)
+	if err != nil {
+		return err
+	}
+
+	sem := make(chan struct{}, mergeDirWorkers)
+	for _, e := range srcEntries {
+		if dstNames[e.Name] {
+			errs = append(errs, fmt.Errorf("MergeDir: \"%s\" already exists in \"%s\"", e.Name, dstDir))
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(e Entry) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			_, err := g.GdriveFilesPatch(e.ID, "", "", []string{dstObj.Id}, []string{srcObj.Id})
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("MergeDir: Error moving \"%s\" to \"%s\": %w", e.Name, dstDir, err))
+				mu.Unlock()
+			}
+		}(e)
+	}
+	wg.Wait()
+
+	// Anything cached under srcDir now points to the wrong place, and
+	// objects moved into dstDir may have been cached as missing.
+	g.InvalidatePath(srcDir)
+	cacheDelPrefix(g.negcache, dstDir)
+
+	if len(errs) > 0 {
+		return errs
+	}
+	if trashSrc {
+		_, err = g.GdriveFilesTrash(srcObj.Id)
+		if err != nil {
+			return fmt.Errorf("MergeDir: Error removing source directory \"%s\": %w", srcDir, err)
+		}
+	}
+	return nil
+}
+
+// Mkdir creates the directory (folder) specified by drivePath. Returns the
+// *drive.File pointing to the object. If the folder already exists, the
+// *drive.File of the existing folder will be returned (this saves one Stat
+// when creating directories.) Concurrent calls to Mkdir on the same path (from
+// this or other processes) return the same directory.
+func (g *Gdrive) Mkdir(drivePath string) (*drive.File, error) {
+	// Sanitize
+	_, _, drivePath = splitPath(drivePath)
+	if drivePath == "" {
+		return nil, fmt.Errorf("Mkdir: Attempting to create a blank directory")
+	}
+
+	// If the path already exists, returns a *drive.File pointing to it
+	driveFile, parent, dirname, err := g.StatOrParent(drivePath)
+	if err != nil {
+		return nil, err
+	}
+	if driveFile != nil {
+		return driveFile, nil
+	}
+
+	driveFile, err = g.GdriveFilesInsert(nil, dirname, parent.Id, mimeTypeFolder)
+	if err != nil {
+		return nil, err
+	}
+
+	// Objects "created" in dry run mode have no ID and cannot be looked up.
+	if driveFile.Id == "" {
+		g.cacheAddPath(drivePath, driveFile)
+		return driveFile, nil
+	}
+
+	// Another client may have created the same directory concurrently. All
+	// racers agree on the oldest directory as the winner; the others are
+	// moved to the trash (they are brand new and empty.)
+	query := fmt.Sprintf("'%s' in parents and title = '%s' and mimeType = '%s' and trashed = false", parent.Id, escapeQuotes(dirname), mimeTypeFolder)
+	dirs, err := g.GdriveFilesList(query, "")
+	if err != nil {
+		return nil, err
+	}
+	if winner := oldestFile(dirs); winner != nil && winner.Id != driveFile.Id {
+		if _, err = g.GdriveFilesTrash(driveFile.Id); err != nil {
+			return nil, fmt.Errorf("Mkdir: Error removing duplicate directory \"%s\": %w", drivePath, err)
+		}
+		driveFile = winner
+	}
+	g.cacheAddPath(drivePath, driveFile)
+	return driveFile, nil
+}
+
+// MkdirAll creates the directory specified by 'drivePath', along with any
+// missing intermediate directories, like os.MkdirAll. Existing directories
+// are left alone. Returns the *drive.File pointing to the last directory in
+// the path.
+func (g *Gdrive) MkdirAll(drivePath string) (*drive.File, error) {
+	var driveFile *drive.File
+
+	// Sanitize
+	_, _, drivePath = splitPath(drivePath)
+	if drivePath == "" {
+		return nil, fmt.Errorf("MkdirAll: Attempting to create a blank directory")
+	}
+
+	elems := strings.Split(strings.TrimPrefix(drivePath, "/"), "/")
+	for idx := range elems {
+		dir := strings.Join(elems[:idx+1], "/")
+		var err error
+		driveFile, err = g.Mkdir(dir)
+		if err != nil {
+			return nil, err
+		}
+		if !IsDir(driveFile) {
+			return nil, fmt.Errorf("MkdirAll: \"%s\" exists and is not a directory", dir)
+		}
+	}
+	return driveFile, nil
+}
+
+// MkdirAllBatch creates all directories in 'paths', along with any missing
+// intermediate directories. Paths are processed in order of depth, and
+// directories shared by more than one path are only created (or looked up)
+// once. Existing directories are left alone.
+//
+// Returns a map of each path in 'paths' that could not be created to the
+// corresponding error. An empty map indicates success.
+func (g *Gdrive) MkdirAllBatch(paths []string) map[string]error {
+	errs := make(map[string]error)
+
+	// Collect all directories and their ancestors, without leading slashes.
+	dirs := make(map[string]bool)
+	for _, p := range paths {
+		_, _, drivePath := splitPath(p)
+		if drivePath == "" {
+			errs[p] = fmt.Errorf("MkdirAllBatch: Attempting to create a blank directory")
+			continue
+		}
+		elems := strings.Split(strings.TrimPrefix(drivePath, "/"), "/")
+		for idx := range elems {
+			dirs[strings.Join(elems[:idx+1], "/")] = true
+		}
+	}
+
+	sorted := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		di, dj := strings.Count(sorted[i], "/"), strings.Count(sorted[j], "/")
+		if di != dj {
+			return di < dj
+		}
+		return sorted[i] < sorted[j]
+	})
+
+	// Parents always come before their children, so a failure is
+	// propagated down without issuing any requests.
+	failed := make(map[string]error)
+	for _, dir := range sorted {
+		if err, ok := failed[path.Dir(dir)]; ok {
+			failed[dir] = err
+			continue
+		}
+		if _, err := g.Mkdir(dir); err != nil {
+			failed[dir] = err
+		}
+	}
+
+	for _, p := range paths {
+		_, _, drivePath := splitPath(p)
+		if err, ok := failed[strings.TrimPrefix(drivePath, "/")]; ok {
+			errs[p] = err
+		}
+	}
+	return errs
+}
+
+// Move renames/moves the object in 'srcPath' (file or directory) to 'dstPath' by
+// calling patch to replace dstPath as the parent of 'srcPath'.  The paths are
+// full paths (dir/dir/dir.../file). The modification date of the object is
+// preserved. Returns the *drive.File containing the destination object.
+func (g *Gdrive) Move(srcPath string, dstPath string) (*drive.File, error) {
+	// Sanitize Source & Destination
+	srcDir, _, srcPath := splitPath(srcPath)
+	dstDir, dstFile, dstPath := splitPath(dstPath)
+
+	if srcPath == "" || dstPath == "" {
+		return nil, fmt.Errorf("Move: Source and destination paths must be set")
+	}
+
+	// We need the source parentId, destination Id and object Id
+	srcParentObj, err := g.Stat(srcDir)
+	if err != nil {
+		return nil, err
+	}
+	srcObj, err := g.Stat(srcPath)
+	if err != nil {
+		return nil, err
+	}
+	dstDirObj, err := g.Stat(dstDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Remove destination file if it exists
+	dstFileObj, err := g.Stat(dstPath)
+	if err != nil && !IsObjectNotFound(err) {
+		return nil, err
+	}
+	if !IsObjectNotFound(err) {
+		_, err = g.GdriveFilesTrash(dstFileObj.Id)
+		if err != nil {
+			return nil, fmt.Errorf("Move: Error removing destination file \"%s\": %w", dstPath, err)
+		}
+		g.cacheDelIDs(map[string]bool{dstFileObj.Id: true})
+	}
+
+	// Set parents and change name if needed. The modification date is left
+	// untouched.
+	driveFile, err := g.GdriveFilesPatch(srcObj.Id, dstFile, "", []string{dstDirObj.Id}, []string{srcParentObj.Id})
+	g.cacheDelIDs(map[string]bool{srcObj.Id: true})
+	g.InvalidatePath(srcPath)
+	if err != nil {
+		return nil, fmt.Errorf("Move: Error moving temporary file \"%s\" to \"%s\": %w", srcPath, dstPath, err)
+	}
+	g.cacheAddPath(dstPath, driveFile)
+	cacheAdd(g.idcache, driveFile.Id, driveFile)
+	return driveFile, nil
+}
+
+// MoveAll moves all objects in 'srcPaths' into the directory 'dstDir',
+// keeping their names. The destination directory is resolved only once,
+// making this much faster than calling Move repeatedly. Objects whose names
+// already exist in dstDir are not moved and are reported as errors. A failure
+// to move one object does not stop the others; the objects successfully moved
+// are returned along with a MultiError containing all failures.
+func (g *Gdrive) MoveAll(srcPaths []string, dstDir string) ([]*drive.File, error) {
+	var (
+		ret  []*drive.File
+		errs MultiError
+	)
+
+	_, _, dstDir = splitPath(dstDir)
+	dstDirObj, err := g.Stat(dstDir)
 	if err != nil {
 		return nil, err
 	}
-	if srcFileObj.DownloadUrl == "" {
-		return nil, fmt.Errorf("Download: File \"%s\" is not downloadable (no body?)", srcPath)
+	if !IsDir(dstDirObj) {
+		return nil, fmt.Errorf("MoveAll: Destination \"%s\" is not a directory", dstDir)
 	}
-
-	req, err := http.NewRequest("GET", srcFileObj.DownloadUrl, nil)
+	dstEntries, err := g.ListDirBrief(dstDir)
 	if err != nil {
 		return nil, err
 	}
+	dstNames := make(map[string]bool, len(dstEntries))
+	for _, e := range dstEntries {
+		dstNames[e.Name] = true
+	}
 
-	resp, err := g.transport.RoundTrip(req)
-	return resp.Body, err
-}
+	for _, srcPath := range srcPaths {
+		srcDir, srcFile, srcPath := splitPath(srcPath)
+		if srcPath == "" {
+			errs = append(errs, fmt.Errorf("MoveAll: empty source path"))
+			continue
+		}
+		if dstNames[srcFile] {
+			errs = append(errs, fmt.Errorf("MoveAll: \"%s\" already exists in \"%s\"", srcFile, dstDir))
+			continue
+		}
+		srcObj, err := g.Stat(srcPath)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		srcParentObj, err := g.Stat(srcDir)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		driveFile, err := g.GdriveFilesPatch(srcObj.Id, "", "", []string{dstDirObj.Id}, []string{srcParentObj.Id})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("MoveAll: Error moving \"%s\" to \"%s\": %w", srcPath, dstDir, err))
+			continue
+		}
+		g.InvalidatePath(srcPath)
+		_, _, dstPath := splitPath(dstDir + "/" + srcFile)
+		g.cacheAddPath(dstPath, driveFile)
+		dstNames[srcFile] = true
+		ret = append(ret, driveFile)
+	}
 
-// DownloadToFile downloads a file named 'srcPath' into 'localFile'. localFile will be
-// overwritten if it exists. The file is first downloaded into a temporary file
-// and then atomically moved into the destination file. Returns the number of bytes
-// downloaded.
-func (g *Gdrive) DownloadToFile(srcPath string, localFile string) (int64, error) {
-	// Sanitize
-	_, _, srcPath = splitPath(srcPath)
-	if srcPath == "" {
-		return 0, fmt.Errorf("DownloadToFile: empty source path")
+	if len(errs) > 0 {
+		return ret, errs
 	}
-	if localFile == "" {
-		return 0, fmt.Errorf("DownloadToFile: empty local file")
+	return ret, nil
+}
+
+// MoveByID moves the object identified by 'fileID' from the directory with ID
+// 'fromParentID' to the directory with ID 'toParentID' with a single request,
+// without resolving any paths. This is the fast path for callers already
+// holding the IDs (e.g. from ListDir). The modification date of the object is
+// preserved. Unlike Move, no checks are made for objects with the same name in
+// the destination.
+//
+// Returns the *drive.File containing the moved object.
+func (g *Gdrive) MoveByID(fileID string, fromParentID string, toParentID string) (*drive.File, error) {
+	if fileID == "" || fromParentID == "" || toParentID == "" {
+		return nil, fmt.Errorf("MoveByID: File and parent IDs must be set")
 	}
-	// If the file exists, it must be a regular file
-	fi, err := os.Stat(localFile)
+	driveFile, err := g.GdriveFilesPatch(fileID, "", "", []string{toParentID}, []string{fromParentID})
 	if err != nil {
-		if os.IsExist(err) && !fi.Mode().IsRegular() {
-			return 0, fmt.Errorf("Download: Local file \"%s\" exists and is not a regular file", localFile)
+		return nil, fmt.Errorf("MoveByID: Error moving fileId \"%s\" to parent \"%s\": %w", fileID, toParentID, err)
+	}
+
+	// Any cached paths for this object point to the old location. Cached
+	// failed lookups of the new location (under every cached path of the
+	// destination directory) are dropped.
+	g.cacheDelIDs(map[string]bool{fileID: true})
+	if driveFile.Title != "" {
+		parents := cacheKeys(g.filecache, func(obj interface{}) bool {
+			return obj.(*drive.File).Id == toParentID
+		})
+		parents = append(parents, cacheKeys(g.childcache, func(obj interface{}) bool {
+			return obj.(*drive.ChildReference).Id == toParentID
+		})...)
+		if toParentID == g.rootID() {
+			parents = append(parents, "/")
+		}
+		for _, parentPath := range parents {
+			_, _, dstPath := splitPath(path.Join("/", parentPath, driveFile.Title))
+			cacheDelPrefix(g.negcache, dstPath)
 		}
 	}
+	cacheAdd(g.idcache, driveFile.Id, driveFile)
+	return driveFile, nil
+}
 
-	srcFileObj, err := g.Stat(srcPath)
+// NeedsUpload returns true if the local file 'localFile' differs from the
+// file pointed by 'dstPath' in Google Drive, or if dstPath does not exist.
+// Files are compared by size and, if the sizes match, by MD5 checksum.
+func (g *Gdrive) NeedsUpload(dstPath string, localFile string) (bool, error) {
+	fi, err := os.Stat(localFile)
 	if err != nil {
-		return 0, err
+		return false, err
 	}
-	if srcFileObj.DownloadUrl == "" {
-		return 0, fmt.Errorf("Download: File \"%s\" is not downloadable (no body?)", srcPath)
+	driveFile, err := g.Stat(dstPath)
+	if IsObjectNotFound(err) {
+		return true, nil
 	}
-
-	// Create a temporary file and write to it, renaming at the end.
-	tmpFile := fmt.Sprintf("temp-%d-%d", rand.Int31(), rand.Int31())
-	tmpWriter, err := os.Create(tmpFile)
 	if err != nil {
-		return 0, err
+		return false, err
 	}
-	defer tmpWriter.Close()
-	defer os.Remove(tmpFile)
+	if IsDir(driveFile) {
+		return false, fmt.Errorf("NeedsUpload: \"%s\" is a directory", dstPath)
+	}
+	if driveFile.Md5Checksum == "" || driveFile.FileSize != fi.Size() {
+		return true, nil
+	}
+	sum, err := md5File(localFile)
+	if err != nil {
+		return false, err
+	}
+	return sum != driveFile.Md5Checksum, nil
+}
 
-	reader, err := g.Download(srcPath)
+// PathForID returns the full path (starting with "/") of the object
+// identified by 'fileID', built by following its parents up to the root
+// directory (see SetRoot). Google Drive allows objects to have more than one
+// parent; in that case, only the first parent of each object is followed.
+// Objects not reachable from the root directory (e.g. files shared with the
+// user) return an error.
+func (g *Gdrive) PathForID(fileID string) (string, error) {
+	var titles []string
+
+	rootObj, err := g.StatID(g.rootID())
 	if err != nil {
-		return 0, err
+		return "", err
+	}
+
+	seen := map[string]bool{}
+	for {
+		driveFile, err := g.StatID(fileID)
+		if err != nil {
+			return "", err
+		}
+		if driveFile.Id == rootObj.Id {
+			break
+		}
+		if seen[driveFile.Id] {
+			return "", fmt.Errorf("PathForID: Loop detected in parents of \"%s\"", fileID)
+		}
+		seen[driveFile.Id] = true
+
+		if len(driveFile.Parents) == 0 {
+			return "", fmt.Errorf("PathForID: Object \"%s\" is not reachable from the root directory", driveFile.Title)
+		}
+		titles = append(titles, driveFile.Title)
+		fileID = driveFile.Parents[0].Id
 	}
 
-	written, err := io.Copy(tmpWriter, reader)
+	// Titles were collected from the object up to the root.
+	for i, j := 0, len(titles)-1; i < j; i, j = i+1, j-1 {
+		titles[i], titles[j] = titles[j], titles[i]
+	}
+	return "/" + strings.Join(titles, "/"), nil
+}
+
+// Quota describes the storage quota of the account, in bytes.
+type Quota struct {
+	Total     int64
+	Used      int64
+	Trashed   int64
+	Remaining int64
+}
+
+// Quota returns the storage quota of the account. Used includes the space
+// used by trashed files, also reported separately in Trashed.
+func (g *Gdrive) Quota() (*Quota, error) {
+	about, err := g.GdriveAboutGet()
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
+	return &Quota{
+		Total:     about.QuotaBytesTotal,
+		Used:      about.QuotaBytesUsed,
+		Trashed:   about.QuotaBytesUsedInTrash,
+		Remaining: about.QuotaBytesTotal - about.QuotaBytesUsed,
+	}, nil
+}
 
-	err = os.Rename(tmpFile, localFile)
+// ReadFile downloads the file pointed by 'drivePath' and returns its
+// contents, like ioutil.ReadFile. Native Google documents are exported to
+// their default format, as with DownloadToFile. This is meant for small files,
+// since the entire contents are kept in memory.
+func (g *Gdrive) ReadFile(drivePath string) ([]byte, error) {
+	_, _, drivePath = splitPath(drivePath)
+	if drivePath == "" {
+		return nil, fmt.Errorf("ReadFile: empty path")
+	}
+	reader, _, err := g.openDownload("ReadFile", drivePath, "")
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
+	defer reader.Close()
 
-	return written, nil
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("ReadFile: Error reading \"%s\": %w", drivePath, err)
+	}
+	return data, nil
 }
 
-// Insert inserts a file named 'dstPath' with the contents coming from
-// 'reader'. The method calls the 'insert' method with the inplace option set
-// to false, causing the file to be writen to a temporary location and then
-// renamed to its final place. This method is safer (but slower) than the
-// InsertInPlace method.
-//
-// Returns *drive.File pointing to the file in its final location.
-func (g *Gdrive) Insert(dstPath string, reader io.Reader) (*drive.File, error) {
-	return g.insert(dstPath, reader, false)
+// Remove moves the object (file or directory) pointed by 'drivePath' to the
+// trash. Directories are moved with all their contents. Trashed objects can
+// be recovered with Restore; use Delete to remove objects permanently.
+func (g *Gdrive) Remove(drivePath string) error {
+	_, _, drivePath = splitPath(drivePath)
+	if drivePath == "" {
+		return fmt.Errorf("Remove: empty path")
+	}
+	driveFile, err := g.Stat(drivePath)
+	if err != nil {
+		return err
+	}
+	_, err = g.GdriveFilesTrash(driveFile.Id)
+	if err != nil {
+		return fmt.Errorf("Remove: Error removing \"%s\": %w", drivePath, err)
+	}
+	cacheDel(g.idcache, driveFile.Id)
+	g.InvalidatePath(drivePath)
+	return nil
 }
 
-// InsertInPlace inserts a file named 'dstPath' with the contents coming from
-// reader. The method calls the 'insert' method with the inplace option set to
-// true, causing the file to be written directly to its final destination. This
-// is faster but (theoretically) less safe than using "Insert".
-//
-// Returns *drive.File: pointing to the file in its final location.
-func (g *Gdrive) InsertInPlace(dstPath string, reader io.Reader) (*drive.File, error) {
-	return g.insert(dstPath, reader, true)
+// ResetRoot undoes SetRoot, resolving paths from the root of the drive again.
+// The cache is flushed.
+func (g *Gdrive) ResetRoot() {
+	g.rootFolder = ""
+	g.FlushCache()
 }
 
-// insert inserts a file named 'dstPath' with the contents coming from reader.
-// If 'inplace' is set to false, this method first inserts the file under
-// driveTmpFolder and then moves it to its final location. If inplace is set
-// to true, the the methdo removes the destination file if it exists and
-// uploads directly (this saves time). driveTmpFolder will be automatically
-// created, if needed.
+// Restore restores the trashed object pointed by 'drivePath' from the
+// trash. Since Stat ignores trashed objects, the parent directory is listed
+// looking for a trashed object with the right name. An error is returned if
+// more than one trashed object with that name exists under the same parent,
+// or if a non-trashed object already exists at 'drivePath'.
 //
-// Returns *drive.File: pointing to the file in its final location.
-func (g *Gdrive) insert(dstPath string, reader io.Reader, inplace bool) (*drive.File, error) {
-	var (
-		outDir     string
-		outFile    string
-		outPath    string
-		parent     *drive.File
-		outFileObj *drive.File
-		err        error
-	)
-
-	if inplace {
-		outDir, outFile, dstPath = splitPath(dstPath)
-		outPath = dstPath
-		parent, err = g.Stat(outDir)
-		if err != nil {
-			return nil, fmt.Errorf("insert: Unable to stat destination directory: \"%s\": %v", outDir, err)
-		}
-	} else {
-		// We upload to DRIVE_TMP_FOLDER so it must always exist
-		parent, err = g.Mkdir(driveTmpFolder)
-		if err != nil {
-			return nil, err
-		}
-
-		outFile = fmt.Sprintf("temp-%d-%d", rand.Int31(), rand.Int31())
-		outPath = driveTmpFolder + "/" + outFile
+// Returns *drive.File pointing to the restored object.
+func (g *Gdrive) Restore(drivePath string) (*drive.File, error) {
+	// Sanitize
+	dir, name, drivePath := splitPath(drivePath)
+	if drivePath == "" {
+		return nil, fmt.Errorf("Restore: empty path")
 	}
 
-	// Delete output object if it already exists (file or directory)
-	outFileObj, err = g.Stat(outPath)
-	if err != nil && !IsObjectNotFound(err) {
+	// Restoring on top of an existing object would create a duplicate.
+	exists, err := g.Exists(drivePath)
+	if err != nil {
 		return nil, err
 	}
-	if !IsObjectNotFound(err) {
-		_, err = g.GdriveFilesTrash(outFileObj.Id)
-		if err != nil {
-			return nil, fmt.Errorf("insert: Error removing (existing) destination file \"%s\": %v", outPath, err)
-		}
+	if exists {
+		return nil, fmt.Errorf("Restore: Object \"%s\" already exists", drivePath)
 	}
 
-	// Insert file
-	outFileObj, err = g.GdriveFilesInsert(reader, outFile, parent.Id, "")
+	trashedID, err := g.findTrashed("Restore", dir, name, drivePath)
 	if err != nil {
-		return nil, fmt.Errorf("insert: Error inserting file \"%s\": %v", outPath, err)
+		return nil, err
 	}
 
-	// Move file to definitive location if needed
-	if !inplace {
-		outFileObj, err = g.Move(outPath, dstPath)
-		if err != nil {
-			return nil, err
+	driveFile, err := g.GdriveFilesUntrash(trashedID)
+	if err != nil {
+		return nil, fmt.Errorf("Restore: Error restoring \"%s\": %w", drivePath, err)
+	}
+	g.cacheAddPath(drivePath, driveFile)
+	return driveFile, nil
+}
+
+// findTrashed returns the ID of the single trashed object named 'name' under
+// the (non trashed) directory 'dir'. 'drivePath' is the full path of the
+// object and 'op' the prefix of error messages.
+func (g *Gdrive) findTrashed(op string, dir string, name string, drivePath string) (string, error) {
+	parent, err := g.Stat(dir)
+	if err != nil {
+		return "", err
+	}
+	query := fmt.Sprintf("title = '%s' and trashed = true", escapeQuotes(name))
+	children, err := g.GdriveChildrenList(parent.Id, query)
+	if err != nil {
+		return "", err
+	}
+	if len(children) == 0 {
+		return "", &Error{
+			ObjectNotFound: true,
+			msg:            fmt.Sprintf("%s: Object \"%s\" not found in trash", op, drivePath),
 		}
-		outPath = dstPath
 	}
+	if len(children) > 1 {
+		return "", fmt.Errorf("%s: More than one trashed object named \"%s\" exists in path \"%s\"", op, name, drivePath)
+	}
+	return children[0].Id, nil
+}
 
-	cacheAdd(g.filecache, outPath, outFileObj)
-	return outFileObj, nil
+// SetCacheTTL sets the time objects are kept in the cache before being
+// fetched again from Google Drive (the default is 60 seconds.) A zero
+// duration (or CacheNeverExpires) causes cached objects to never expire,
+// while a negative duration disables the cache.
+func (g *Gdrive) SetCacheTTL(d time.Duration) {
+	if d == CacheNeverExpires {
+		d = 0
+	}
+	g.cacheTTL = d
 }
 
-// ListDir returns a slice of *drive.File objects under 'drivePath' matching 'query'
-// (in Google Drive query format.) If query is blank, it defaults to 'trashed =
-// false'.
-func (g *Gdrive) ListDir(drivePath string, query string) ([]*drive.File, error) {
-	var ret []*drive.File
+// SetRetryPredicate sets a function to decide whether a failed operation
+// should be retried, replacing the default policy of retrying 5xx and 403 rate
+// limit errors. The function receives the error (as an *APIError when returned
+// by Google Drive, so IsRateLimited and friends can be used) and the number of
+// the attempt that failed (starting at 1) and returns true to retry. Operations are never
+// tried more than the maximum number of tries. Passing nil restores the
+// default policy.
+func (g *Gdrive) SetRetryPredicate(fn func(err error, attempt int) bool) {
+	g.retryPredicate = fn
+}
 
-	driveDir, err := g.Stat(drivePath)
-	if err != nil {
-		return nil, err
+// SetNegativeCacheTTL enables caching of failed lookups: when Stat does not
+// find an object, further lookups of the same path fail immediately (without
+// contacting Google Drive) during 'd'. Objects created or moved through this
+// object are visible immediately, but objects created by other clients in the
+// meantime may not be visible until the entry expires; use InvalidatePath to
+// force a fresh lookup. Zero (the default) disables negative caching.
+func (g *Gdrive) SetNegativeCacheTTL(d time.Duration) {
+	g.negativeTTL = d
+	g.negcache = &map[string]*objCache{}
+}
+
+// SetPageSize sets the maximum number of objects requested per page when
+// listing directories. Larger pages mean fewer requests; smaller pages reduce
+// memory usage and latency to the first result with ListDirFunc. Zero (the
+// default) uses the server default.
+func (g *Gdrive) SetPageSize(n int) {
+	if n < 0 {
+		n = 0
 	}
+	g.pageSize = int64(n)
+}
 
-	if query == "" {
-		query = "trashed = false"
+// SetRateLimit limits the rate of requests sent to Google Drive to
+// 'perSecond' requests per second, allowing bursts of up to 'burst' requests.
+// Requests exceeding the limit wait until allowed to proceed. A zero (or
+// negative) rate removes the limit.
+func (g *Gdrive) SetRateLimit(perSecond float64, burst int) {
+	if perSecond <= 0 {
+		g.limiter = nil
+		return
 	}
-	children, err := g.GdriveChildrenList(driveDir.Id, query)
+	if burst < 1 {
+		burst = 1
+	}
+	g.limiter = rate.NewLimiter(rate.Limit(perSecond), burst)
+}
+
+// SetRetryPolicy sets the maximum number of tries (including the first
+// attempt) for operations failing with a retriable error, and the base delay
+// of the exponential backoff between them. The n-th retry waits base*2^(n-1)
+// plus a random jitter of up to 'base'. Values lower than 1 (or zero for the
+// delay) restore the defaults.
+func (g *Gdrive) SetRetryPolicy(maxTries int, base time.Duration) {
+	if maxTries < 1 {
+		maxTries = numTries
+	}
+	if base <= 0 {
+		base = retryBaseDelay
+	}
+	g.maxTries = maxTries
+	g.retryBase = base
+}
+
+// SetRoot confines the library to the directory 'drivePath': from now on, all
+// paths are resolved relative to it, so "/" refers to drivePath itself and
+// objects outside of it cannot be reached. drivePath is resolved relative to
+// the current root. Setting the root to "/" or a blank path keeps the current
+// root; use ResetRoot to go back to the root of the drive. The cache is
+// flushed, since cached paths refer to the previous root.
+func (g *Gdrive) SetRoot(drivePath string) error {
+	_, _, drivePath = splitPath(drivePath)
+	if drivePath == "" {
+		return nil
+	}
+	driveFile, err := g.Stat(drivePath)
 	if err != nil {
-		return nil, fmt.Errorf("ListDir: Error retrieving ChildrenList for path \"%s\": %v", drivePath, err)
+		return err
 	}
+	if !IsDir(driveFile) {
+		return fmt.Errorf("SetRoot: \"%s\" is not a directory", drivePath)
+	}
+	g.rootFolder = driveFile.Id
+	g.FlushCache()
+	return nil
+}
 
-	for _, child := range children {
-		driveFile, err := g.GdriveFilesGet(child.Id)
-		if err != nil {
-			return nil, fmt.Errorf("ListDir: Error fetching file metadata for path \"%s\": %v", drivePath, err)
-		}
-		ret = append(ret, driveFile)
+// SetTmpFolder sets the directory used to hold temporary copies of files
+// during inserts. 'drivePath' may be a full path and will be created (along
+// with any missing parents) on the first insert. An empty path restores the
+// default ("tmp" at the root of the drive.)
+func (g *Gdrive) SetTmpFolder(drivePath string) {
+	_, _, drivePath = splitPath(drivePath)
+	if drivePath == "" {
+		drivePath = driveTmpFolder
 	}
+	g.tmpFolder = drivePath
+}
 
-	return ret, nil
+// SetValidationInterval enables cheap validation of cached objects: when an
+// object found in the cache was last checked more than 'd' ago, only its
+// modification date is fetched from Google Drive, and the object is fetched
+// again if it changed. This gives near-fresh results at a fraction of the
+// cost of a full lookup. A zero duration (the default) disables validation
+// and cached objects are used until they expire (see SetCacheTTL.)
+func (g *Gdrive) SetValidationInterval(d time.Duration) {
+	g.validationInterval = d
 }
 
-// Mkdir creates the directory (folder) specified by drivePath. Returns the
-// *drive.File pointing to the object. If the folder already exists, the
-// *drive.File of the existing folder will be returned (this saves one Stat
-// when creating directories.)
-func (g *Gdrive) Mkdir(drivePath string) (*drive.File, error) {
-	var parentID string
+// SetDebugLevel sets the debug level for future uses of the log.Debug{ln,f}
+// methods. This has no effect on loggers set with SetLogger.
+func (g *Gdrive) SetDebugLevel(n int) {
+	g.deflog.SetDebugLevel(n)
+}
 
-	// Sanitize
-	pathname, dirname, drivePath := splitPath(drivePath)
-	if drivePath == "" {
-		return nil, fmt.Errorf("Mkdir: Attempting to create a blank directory")
+// SetDryRun enables or disables dry run mode. In dry run mode, operations
+// that would change objects in Google Drive (inserting, patching, moving,
+// trashing, deleting, etc) only log what they would do (with verbose level 1)
+// and return a synthetic result. Read operations are still executed. Since
+// the cache reflects the simulated changes, it is flushed when dry run mode
+// is disabled.
+func (g *Gdrive) SetDryRun(dryRun bool) {
+	if g.dryRun && !dryRun {
+		g.FlushCache()
 	}
+	g.dryRun = dryRun
+}
 
-	// If the path already exists, returns a *drive.File pointing to it
+// SetDriveID makes all operations work on the shared drive (Team Drive) with
+// ID 'teamDriveID' instead of the user's own drive: paths are resolved from
+// the root of the shared drive, and listings only return objects inside it.
+// A blank ID restores the default. Any root set with SetRoot is reset, and the
+// cache is flushed, since cached paths refer to the previous drive.
+func (g *Gdrive) SetDriveID(teamDriveID string) {
+	g.driveID = teamDriveID
+	g.rootFolder = ""
+	g.FlushCache()
+}
+
+// SetFollowSymlinks controls whether InsertFile and UploadDir follow symbolic
+// links to upload the contents of their targets (the default) or skip them.
+func (g *Gdrive) SetFollowSymlinks(follow bool) {
+	g.followSymlinks = follow
+}
+
+// SetVerboseLevel sets the verbose level for future uses of the
+// log.Verbose{ln,f} methods. This has no effect on loggers set with SetLogger.
+func (g *Gdrive) SetVerboseLevel(n int) {
+	g.deflog.SetVerboseLevel(n)
+}
+
+// SetDescription sets the description of the file/directory specified by
+// 'drivePath' to 'description'. A blank description removes it. Returns
+// *drive.File pointing to the modified file/dir.
+func (g *Gdrive) SetDescription(drivePath string, description string) (*drive.File, error) {
 	driveFile, err := g.Stat(drivePath)
-	if err != nil && !IsObjectNotFound(err) {
+	if err != nil {
 		return nil, err
 	}
-	if !IsObjectNotFound(err) {
-		return driveFile, err
+
+	patch := &drive.File{
+		Description:     description,
+		ForceSendFields: []string{"Description"},
+	}
+	driveFile, err = g.gdriveFilesPatch(driveFile.Id, patch, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("SetDescription: Error setting description of \"%s\": %w", drivePath, err)
+	}
+	_, _, drivePath = splitPath(drivePath)
+	cacheAdd(g.filecache, drivePath, driveFile)
+	return driveFile, nil
+}
+
+// SetLogger routes all diagnostic messages to 'l', replacing the default
+// logger. Passing nil restores the default logger.
+func (g *Gdrive) SetLogger(l Logger) {
+	if l == nil {
+		l = g.deflog
 	}
+	g.log = l
+}
 
-	// If no path, start at root
-	if pathname == "" {
-		parentID = "root"
-	} else {
-		driveFile, err = g.Stat(pathname)
-		if err != nil {
-			return nil, err
-		}
-		parentID = driveFile.Id
+// SetMetricsHook sets a function to be called after every request sent to
+// Google Drive, with the name of the operation (e.g. "Files.Get",
+// "Permissions.List" or "Download"), how long it took and its error (nil on
+// success). Retried requests are reported once per attempt. For downloads,
+// the time until the response headers arrive is reported. Passing nil (the
+// default) disables the hook.
+func (g *Gdrive) SetMetricsHook(fn func(op string, duration time.Duration, err error)) {
+	g.metricsHook = fn
+}
+
+// SetModifiedDate sets the modification date of the file/directory specified
+// by 'drivePath' to 'modifiedDate'. Returns *drive.File pointing to the
+// modified file/dir.
+func (g *Gdrive) SetModifiedDate(drivePath string, modifiedDate time.Time) (*drive.File, error) {
+
+	driveFile, err := g.Stat(drivePath)
+	if err != nil {
+		return nil, err
 	}
 
-	driveFile, err = g.GdriveFilesInsert(nil, dirname, parentID, mimeTypeFolder)
+	// Set Date
+	driveFile, err = g.GdriveFilesPatch(driveFile.Id, "", driveDate(modifiedDate), nil, nil)
 	if err != nil {
 		return nil, err
 	}
+	g.cacheDelIDs(map[string]bool{driveFile.Id: true})
+	_, _, drivePath = splitPath(drivePath)
 	cacheAdd(g.filecache, drivePath, driveFile)
 	return driveFile, nil
 }
 
-// Move renames/moves the object in 'srcPath' (file or directory) to 'dstPath' by
-// calling patch to replace dstPath as the parent of 'srcPath'.  The paths are
-// full paths (dir/dir/dir.../file).  Returns the *drive.File containing the
-// destination object.
-func (g *Gdrive) Move(srcPath string, dstPath string) (*drive.File, error) {
-	// Sanitize Source & Destination
-	srcDir, _, srcPath := splitPath(srcPath)
-	dstDir, dstFile, dstPath := splitPath(dstPath)
+// SetProperty sets the custom property 'key' of the file/directory specified
+// by 'drivePath' to 'value'. Properties survive moves and renames. Private
+// properties are only visible to this application; public properties are
+// visible to all applications if 'public' is true.
+func (g *Gdrive) SetProperty(drivePath string, key string, value string, public bool) error {
+	if key == "" {
+		return fmt.Errorf("SetProperty: empty key")
+	}
+	driveFile, err := g.Stat(drivePath)
+	if err != nil {
+		return err
+	}
 
-	if srcPath == "" || dstPath == "" {
-		return nil, fmt.Errorf("Move: Source and destination paths must be set")
+	prop := &drive.Property{Key: key, Value: value, Visibility: "PRIVATE"}
+	if public {
+		prop.Visibility = "PUBLIC"
 	}
+	if _, err = g.GdrivePropertiesInsert(driveFile.Id, prop); err != nil {
+		return fmt.Errorf("SetProperty: Error setting property \"%s\" of \"%s\": %w", key, drivePath, err)
+	}
+	// The cached object holds stale properties.
+	_, _, drivePath = splitPath(drivePath)
+	cacheDel(g.filecache, drivePath)
+	return nil
+}
 
-	// We need the source parentId, destination Id and object Id
-	srcParentObj, err := g.Stat(srcDir)
+// Snapshot returns a map of all objects directly under 'drivePath', keyed by
+// title. The result can be saved and later compared to a newer snapshot with
+// DiffSnapshots.
+func (g *Gdrive) Snapshot(drivePath string) (map[string]*drive.File, error) {
+	files, err := g.ListDir(drivePath, "")
 	if err != nil {
 		return nil, err
 	}
-	srcObj, err := g.Stat(srcPath)
-	if err != nil {
-		return nil, err
+	ret := make(map[string]*drive.File, len(files))
+	for _, driveFile := range files {
+		ret[driveFile.Title] = driveFile
 	}
-	dstDirObj, err := g.Stat(dstDir)
+	return ret, nil
+}
+
+// Star marks the object pointed by 'drivePath' as starred. Returns
+// *drive.File pointing to the modified object.
+func (g *Gdrive) Star(drivePath string) (*drive.File, error) {
+	return g.setStarred("Star", drivePath, true)
+}
+
+// setStarred implements Star and Unstar.
+func (g *Gdrive) setStarred(op string, drivePath string, starred bool) (*drive.File, error) {
+	_, _, drivePath = splitPath(drivePath)
+	driveFile, err := g.Stat(drivePath)
 	if err != nil {
 		return nil, err
 	}
 
-	// Remove destination file if it exists
-	dstFileObj, err := g.Stat(dstPath)
-	if err != nil && !IsObjectNotFound(err) {
-		return nil, err
+	patch := &drive.File{
+		Labels: &drive.FileLabels{
+			Starred:         starred,
+			ForceSendFields: []string{"Starred"},
+		},
 	}
-	if !IsObjectNotFound(err) {
-		_, err = g.GdriveFilesTrash(dstFileObj.Id)
-		if err != nil {
-			return nil, fmt.Errorf("Move: Error removing destination file \"%s\": %v", dstPath, err)
-		}
-		cacheDel(g.filecache, dstPath)
-	}
-
-	// Set parents and change name if needed
-	driveFile, err := g.GdriveFilesPatch(srcObj.Id, dstFile, "", []string{dstDirObj.Id}, []string{srcParentObj.Id})
-	cacheDel(g.filecache, srcPath)
+	driveFile, err = g.gdriveFilesPatch(driveFile.Id, patch, nil, nil)
 	if err != nil {
-		return nil, fmt.Errorf("Move: Error moving temporary file \"%s\" to \"%s\": %v", srcPath, dstPath, err)
+		return nil, fmt.Errorf("%s: Error changing \"%s\": %w", op, drivePath, err)
 	}
-	cacheAdd(g.filecache, dstPath, driveFile)
+	cacheAdd(g.filecache, drivePath, driveFile)
 	return driveFile, nil
 }
 
-// SetDebugLevel sets the debug level for future uses of the log.Debug{ln,f} methods.
-func (g *Gdrive) SetDebugLevel(n int) {
-	g.log.SetDebugLevel(n)
+// StartPageToken returns a token pointing to the current state of Google
+// Drive. Use it with Changes to retrieve changes made after this call.
+func (g *Gdrive) StartPageToken() (string, error) {
+	token, err := g.GdriveChangesGetStartPageToken()
+	if err != nil {
+		return "", fmt.Errorf("StartPageToken: Error retrieving start page token: %w", err)
+	}
+	return token, nil
 }
 
-// SetVerboseLevel sets the verbose level for future uses of the log.Verbose{ln,f} methods.
-func (g *Gdrive) SetVerboseLevel(n int) {
-	g.log.SetVerboseLevel(n)
+// SyncSummary holds the number of files changed by SyncDir.
+type SyncSummary struct {
+	Added   int
+	Updated int
+	Deleted int
 }
 
-// SetModifiedDate sets the modification date of the file/directory specified
-// by 'drivePath' to 'modifiedDate'. Returns *drive.File pointing to the
-// modified file/dir.
-func (g *Gdrive) SetModifiedDate(drivePath string, modifiedDate time.Time) (*drive.File, error) {
+// SyncDir makes 'drivePath' a copy of the local directory 'localDir',
+// creating missing directories and uploading new and changed files (see
+// NeedsUpload). Unchanged files are not uploaded. If 'deleteExtra' is true,
+// objects under drivePath that do not exist locally are moved to the trash.
+// Symbolic links are handled as in UploadDir; skipped local files do not cause
+// their remote copies to be removed. Returns a summary of the changes made.
+func (g *Gdrive) SyncDir(localDir string, drivePath string, deleteExtra bool) (SyncSummary, error) {
+	var summary SyncSummary
 
-	driveFile, err := g.Stat(drivePath)
-	if err != nil {
-		return nil, err
+	localDir = filepath.Clean(localDir)
+	_, _, drivePath = splitPath(drivePath)
+	if drivePath == "" {
+		return summary, fmt.Errorf("SyncDir: empty destination path")
+	}
+	if _, err := g.MkdirAll(drivePath); err != nil {
+		return summary, err
 	}
 
-	// For some reason Gdrive requires the date to contain the nano information
-	// and Format will return a date without nano information if it happens to
-	// be zero. Add 1ns to make sure format will produce a date in the right format.
-	modifiedDate = modifiedDate.Truncate(1 * time.Second)
-	modifiedDate = modifiedDate.Add(1 * time.Nanosecond)
-	rfcDate := modifiedDate.Format(time.RFC3339Nano)
+	// Paths (relative to drivePath) present locally.
+	local := make(map[string]bool)
+	err := filepath.Walk(localDir, func(localPath string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(localDir, localPath)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		dstPath := path.Join(drivePath, rel)
+
+		if fi.IsDir() {
+			local[rel] = true
+			_, err = g.MkdirAll(dstPath)
+			return err
+		}
+		// Skipped files still exist locally.
+		local[rel] = true
+		if !g.uploadable("SyncDir", localPath, fi) {
+			return nil
+		}
 
-	// Set Date
-	driveFile, err = g.GdriveFilesPatch(driveFile.Id, "", rfcDate, nil, nil)
-	if err != nil {
-		return nil, err
+		exists, err := g.Exists(dstPath)
+		if err != nil {
+			return err
+		}
+		needed, err := g.NeedsUpload(dstPath, localPath)
+		if err != nil || !needed {
+			return err
+		}
+		if _, err = g.InsertFile(dstPath, localPath); err != nil {
+			return err
+		}
+		if exists {
+			summary.Updated++
+		} else {
+			summary.Added++
+		}
+		return nil
+	})
+	if err != nil || !deleteExtra {
+		return summary, err
 	}
-	cacheAdd(g.filecache, drivePath, driveFile)
-	return driveFile, nil
+
+	root := strings.TrimPrefix(drivePath, "/")
+	err = g.Walk(drivePath, func(p string, driveFile *drive.File, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(p, "/"), root)
+		rel = strings.TrimPrefix(rel, "/")
+		if rel == "" {
+			rel = "."
+		}
+		if local[rel] {
+			return nil
+		}
+		if err = g.Remove(p); err != nil {
+			return err
+		}
+		summary.Deleted++
+		if IsDir(driveFile) {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return summary, err
 }
 
 // Stat returns the *drive.File object for the last element in 'drivePath'.  The
@@ -361,6 +2411,64 @@ func (g *Gdrive) SetModifiedDate(drivePath string, modifiedDate time.Time) (*dri
 //
 // Returns *drive.File object of the object pointed by the full path.
 func (g *Gdrive) Stat(drivePath string) (*drive.File, error) {
+	return g.StatContext(context.Background(), drivePath)
+}
+
+// StatAll works like Stat, but returns all objects named 'drivePath' instead
+// of failing when more than one object with the same name exists in the same
+// directory. Directories in the path must still be unique.
+func (g *Gdrive) StatAll(drivePath string) ([]*drive.File, error) {
+	// Sanitize
+	dirs, filename, drivePath := splitPath(drivePath)
+	if drivePath == "" {
+		return nil, fmt.Errorf("StatAll: Trying to stat blank path")
+	}
+
+	parentObj, err := g.Stat(dirs)
+	if err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf("'%s' in parents and title = '%s' and trashed = false", parentObj.Id, escapeQuotes(filename))
+	ret, err := g.GdriveFilesList(query, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(ret) == 0 {
+		return nil, &Error{
+			ObjectNotFound: true,
+			msg:            fmt.Sprintf("StatAll: Object \"%s\" not found", drivePath),
+		}
+	}
+	return ret, nil
+}
+
+// StatContext works like Stat, but all requests made to Google Drive while
+// resolving the path are bound to 'ctx'.
+func (g *Gdrive) StatContext(ctx context.Context, drivePath string) (*drive.File, error) {
+	// Cached? Objects are cached under the sanitized path.
+	_, _, key := splitPath(drivePath)
+	driveFile := cacheGet(g.filecache, key, g.cacheTTL)
+	if driveFile != nil && g.cacheValid(ctx, key, driveFile.(*drive.File)) {
+		return driveFile.(*drive.File), nil
+	}
+
+	// Recently not found? (see SetNegativeCacheTTL)
+	if g.negativeTTL <= 0 {
+		return g.stat(ctx, drivePath)
+	}
+	if cerr := cacheGet(g.negcache, key, g.negativeTTL); cerr != nil {
+		return nil, cerr.(error)
+	}
+	ret, err := g.stat(ctx, drivePath)
+	if IsObjectNotFound(err) {
+		cacheAdd(g.negcache, key, err)
+	}
+	return ret, err
+}
+
+// stat implements StatContext, without checking the cache for 'drivePath'
+// itself.
+func (g *Gdrive) stat(ctx context.Context, drivePath string) (*drive.File, error) {
 	var (
 		children []*drive.ChildReference
 		query    string
@@ -368,15 +2476,9 @@ func (g *Gdrive) Stat(drivePath string) (*drive.File, error) {
 		subdirs  []string
 	)
 
-	// Cached?
-	driveFile := cacheGet(g.filecache, drivePath)
-	if driveFile != nil {
-		return driveFile.(*drive.File), nil
-	}
-
 	// Special case for "/" (root)
 	if drivePath == "/" {
-		return g.GdriveFilesGet("root")
+		return g.GdriveFilesGetContext(ctx, g.rootID())
 	}
 
 	// Sanitize
@@ -385,7 +2487,7 @@ func (g *Gdrive) Stat(drivePath string) (*drive.File, error) {
 		return nil, fmt.Errorf("Stat: Trying to stat blank path")
 	}
 
-	parent := "root"
+	parent := g.rootID()
 
 	// We make sure that:
 	// - Every element in our path exists
@@ -403,13 +2505,13 @@ func (g *Gdrive) Stat(drivePath string) (*drive.File, error) {
 
 			// If partial path cached, we set the parent to the id
 			// of the cached object and keep traversing down the path.
-			child := cacheGet(g.childcache, ppath)
+			child := cacheGet(g.childcache, ppath, g.cacheTTL)
 			if child != nil {
 				parent = child.(*drive.ChildReference).Id
 			} else {
 				// Test: No elements in our directory path are files
 				query = fmt.Sprintf("title = '%s' and trashed = false and mimeType != '%s'", escapeQuotes(elem), mimeTypeFolder)
-				children, err = g.GdriveChildrenList(parent, query)
+				children, err = g.GdriveChildrenListContext(ctx, parent, query)
 
 				if err != nil {
 					return nil, err
@@ -420,7 +2522,7 @@ func (g *Gdrive) Stat(drivePath string) (*drive.File, error) {
 
 				// Test: One and only one directory
 				query = fmt.Sprintf("title = '%s' and trashed = false and mimeType = '%s'", escapeQuotes(elem), mimeTypeFolder)
-				children, err = g.GdriveChildrenList(parent, query)
+				children, err = g.GdriveChildrenListContext(ctx, parent, query)
 				if err != nil {
 					return nil, err
 				}
@@ -445,7 +2547,7 @@ func (g *Gdrive) Stat(drivePath string) (*drive.File, error) {
 
 	if filename != "" {
 		query = fmt.Sprintf("title = '%s' and trashed = false", escapeQuotes(filename))
-		children, err = g.GdriveChildrenList(parent, query)
+		children, err = g.GdriveChildrenListContext(ctx, parent, query)
 		if err != nil {
 			return nil, err
 		}
@@ -463,9 +2565,427 @@ func (g *Gdrive) Stat(drivePath string) (*drive.File, error) {
 
 	// Parent contains the id of the last element
 
-	ret, err := g.GdriveFilesGet(parent)
+	ret, err := g.GdriveFilesGetContext(ctx, parent)
 	if err == nil {
 		cacheAdd(g.filecache, drivePath, ret)
 	}
 	return ret, err
 }
+
+// cacheValid returns true if the cached 'driveFile' (stored under
+// 'drivePath') can be used. If cache validation is enabled and the object is
+// due for a check, its modification date is compared to the one in Google
+// Drive and the object is removed from the cache if they differ. Errors
+// during validation also cause the object to be evicted.
+func (g *Gdrive) cacheValid(ctx context.Context, drivePath string, driveFile *drive.File) bool {
+	if g.validationInterval <= 0 || !cacheNeedsValidation(g.filecache, drivePath, g.validationInterval) {
+		return true
+	}
+	f, err := g.gdriveFilesGetFields(ctx, driveFile.Id, "modifiedDate")
+	if err != nil || f.ModifiedDate != driveFile.ModifiedDate {
+		cacheDel(g.filecache, drivePath)
+		return false
+	}
+	cacheSetValidated(g.filecache, drivePath)
+	return true
+}
+
+// StatID returns a *drive.File object for the object identified by 'fileID'.
+// Unlike GdriveFilesGet, results are cached (keyed by ID) and subject to the
+// same TTL as path based lookups.
+func (g *Gdrive) StatID(fileID string) (*drive.File, error) {
+	if fileID == "" {
+		return nil, fmt.Errorf("StatID: empty file ID")
+	}
+	if driveFile := cacheGet(g.idcache, fileID, g.cacheTTL); driveFile != nil {
+		return driveFile.(*drive.File), nil
+	}
+	driveFile, err := g.GdriveFilesGet(fileID)
+	if err != nil {
+		return nil, err
+	}
+	cacheAdd(g.idcache, fileID, driveFile)
+	return driveFile, nil
+}
+
+// StatIncludingTrash works like Stat, but also finds the object pointed by
+// 'drivePath' if it has been moved to the trash. Non trashed objects take
+// precedence. Only the last element in the path may be trashed. Trashed
+// objects are not cached.
+func (g *Gdrive) StatIncludingTrash(drivePath string) (*drive.File, error) {
+	driveFile, err := g.Stat(drivePath)
+	if err == nil || !IsObjectNotFound(err) {
+		return driveFile, err
+	}
+
+	dir, name, drivePath := splitPath(drivePath)
+	trashedID, err := g.findTrashed("StatIncludingTrash", dir, name, drivePath)
+	if err != nil {
+		return nil, err
+	}
+	return g.GdriveFilesGet(trashedID)
+}
+
+// StatNewest works like StatAll, but returns only the object with the most
+// recent modification date.
+func (g *Gdrive) StatNewest(drivePath string) (*drive.File, error) {
+	files, err := g.StatAll(drivePath)
+	if err != nil {
+		return nil, err
+	}
+	newest, err := newestFile(files)
+	if err != nil {
+		return nil, fmt.Errorf("StatNewest: Error parsing modification date of \"%s\": %w", drivePath, err)
+	}
+	return newest, nil
+}
+
+// StatOrParent resolves 'drivePath' tolerating a missing last element. If
+// the object exists, 'file' points to it. If only its parent directory exists,
+// 'parent' points to the parent directory and 'missingName' holds the name of
+// the missing element. Any other condition (including a missing parent)
+// returns an error.
+func (g *Gdrive) StatOrParent(drivePath string) (file *drive.File, parent *drive.File, missingName string, err error) {
+	dir, name, drivePath := splitPath(drivePath)
+	if drivePath == "" {
+		return nil, nil, "", fmt.Errorf("StatOrParent: Trying to stat blank path")
+	}
+
+	file, err = g.Stat(drivePath)
+	if err == nil {
+		return file, nil, "", nil
+	}
+	if !IsObjectNotFound(err) {
+		return nil, nil, "", err
+	}
+
+	parent, err = g.Stat(dir)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if !IsDir(parent) {
+		return nil, nil, "", fmt.Errorf("StatOrParent: \"%s\" is a file, not a directory", dir)
+	}
+	return nil, parent, name, nil
+}
+
+// rootID returns the ID of the directory all paths are relative to: the
+// directory set with SetRoot, the root folder of the shared drive (whose ID is
+// the drive ID) if one was set with SetDriveID, or the "root" alias of the
+// user's drive otherwise.
+func (g *Gdrive) rootID() string {
+	if g.rootFolder != "" {
+		return g.rootFolder
+	}
+	if g.driveID != "" {
+		return g.driveID
+	}
+	return "root"
+}
+
+// tmpDir returns the *drive.File pointing to the temporary folder, creating it
+// (and any missing parents) if needed. A file with the same name would make
+// every upload fail, so we make sure an existing object is a directory before
+// using it as the parent of our uploads.
+func (g *Gdrive) tmpDir() (*drive.File, error) {
+	driveFile, err := g.Stat(g.tmpFolder)
+	if IsObjectNotFound(err) {
+		return g.MkdirAll(g.tmpFolder)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !IsDir(driveFile) {
+		return nil, fmt.Errorf("tmpDir: Temporary folder \"%s\" exists but is a file, not a directory. Please rename or remove it", g.tmpFolder)
+	}
+	return driveFile, nil
+}
+
+// Truncate empties the contents of the file pointed by 'drivePath', keeping
+// its ID, parents and permissions (and thus any sharing links), as with
+// Update. If 'drivePath' does not exist, an empty file is created. This is
+// useful for lock and marker files.
+//
+// Returns *drive.File pointing to the truncated (or created) file.
+func (g *Gdrive) Truncate(drivePath string) (*drive.File, error) {
+	_, _, drivePath = splitPath(drivePath)
+	if drivePath == "" {
+		return nil, fmt.Errorf("Truncate: empty path")
+	}
+	dstFileObj, err := g.Stat(drivePath)
+	if IsObjectNotFound(err) {
+		return g.Insert(drivePath, bytes.NewReader(nil))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if IsDir(dstFileObj) {
+		return nil, fmt.Errorf("Truncate: \"%s\" is a directory", drivePath)
+	}
+
+	driveFile, err := g.GdriveFilesUpdate(dstFileObj.Id, bytes.NewReader(nil))
+	if err != nil {
+		return nil, fmt.Errorf("Truncate: Error truncating \"%s\": %w", drivePath, err)
+	}
+	g.cacheDelIDs(map[string]bool{driveFile.Id: true})
+	cacheAdd(g.filecache, drivePath, driveFile)
+	cacheAdd(g.idcache, driveFile.Id, driveFile)
+	return driveFile, nil
+}
+
+// Unlink removes 'drivePath' from the parents of the object it points to,
+// keeping the object under its other parents (see Link). It is an error to
+// unlink an object with a single parent; use Remove instead.
+func (g *Gdrive) Unlink(drivePath string) (*drive.File, error) {
+	dir, _, drivePath := splitPath(drivePath)
+	if drivePath == "" {
+		return nil, fmt.Errorf("Unlink: empty path")
+	}
+	driveFile, err := g.Stat(drivePath)
+	if err != nil {
+		return nil, err
+	}
+	if len(driveFile.Parents) < 2 {
+		return nil, fmt.Errorf("Unlink: \"%s\" has a single parent (use Remove instead)", drivePath)
+	}
+	dirObj, err := g.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	driveFile, err = g.GdriveFilesPatch(driveFile.Id, "", "", nil, []string{dirObj.Id})
+	if err != nil {
+		return nil, fmt.Errorf("Unlink: Error unlinking \"%s\": %w", drivePath, err)
+	}
+	g.InvalidatePath(drivePath)
+	return driveFile, nil
+}
+
+// Unstar removes the star from the object pointed by 'drivePath'. Returns
+// *drive.File pointing to the modified object.
+func (g *Gdrive) Unstar(drivePath string) (*drive.File, error) {
+	return g.setStarred("Unstar", drivePath, false)
+}
+
+// Update replaces the contents of the file pointed by 'drivePath' with the
+// contents read from 'reader', keeping its ID, parents and permissions (and
+// thus any sharing links.) A new revision is created. If 'drivePath' does not
+// exist, a new file is inserted as with Insert.
+func (g *Gdrive) Update(drivePath string, reader io.Reader) (*drive.File, error) {
+	_, _, drivePath = splitPath(drivePath)
+	if drivePath == "" {
+		return nil, fmt.Errorf("Update: empty path")
+	}
+	dstFileObj, err := g.Stat(drivePath)
+	if IsObjectNotFound(err) {
+		return g.Insert(drivePath, reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if IsDir(dstFileObj) {
+		return nil, fmt.Errorf("Update: \"%s\" is a directory", drivePath)
+	}
+
+	driveFile, err := g.GdriveFilesUpdate(dstFileObj.Id, reader)
+	if err != nil {
+		return nil, fmt.Errorf("Update: Error updating \"%s\": %w", drivePath, err)
+	}
+	g.cacheDelIDs(map[string]bool{driveFile.Id: true})
+	cacheAdd(g.filecache, drivePath, driveFile)
+	cacheAdd(g.idcache, driveFile.Id, driveFile)
+	return driveFile, nil
+}
+
+// UploadDir recursively uploads the contents of the local directory
+// 'localDir' into 'drivePath', creating directories as needed. 'drivePath'
+// itself will be created if it does not exist, but its parent must exist.
+//
+// Symbolic links to files are followed and the contents of their targets
+// uploaded, unless disabled with SetFollowSymlinks(false). Broken symbolic
+// links, links to directories and other non-regular files are skipped with a
+// warning in the log.
+func (g *Gdrive) UploadDir(localDir string, drivePath string) error {
+	localDir = filepath.Clean(localDir)
+
+	return filepath.Walk(localDir, func(localPath string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(localDir, localPath)
+		if err != nil {
+			return err
+		}
+		dstPath := path.Join(drivePath, filepath.ToSlash(rel))
+
+		if fi.IsDir() {
+			_, err = g.Mkdir(dstPath)
+			return err
+		}
+
+		if !g.uploadable("UploadDir", localPath, fi) {
+			return nil
+		}
+		_, err = g.InsertFile(dstPath, localPath)
+		return err
+	})
+}
+
+// uploadable returns true if the local non-directory object 'localPath'
+// (described by 'fi') can be uploaded: regular files, and symbolic links to
+// regular files if following symlinks is enabled. Other objects are logged
+// (prefixed by 'op') and skipped.
+func (g *Gdrive) uploadable(op string, localPath string, fi os.FileInfo) bool {
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if !g.followSymlinks {
+			g.log.Verbosef(1, "%s: Skipping symbolic link \"%s\"\n", op, localPath)
+			return false
+		}
+		target, err := os.Stat(localPath)
+		if err != nil {
+			g.log.Verbosef(1, "%s: Skipping broken symbolic link \"%s\": %v\n", op, localPath, err)
+			return false
+		}
+		if !target.Mode().IsRegular() {
+			g.log.Verbosef(1, "%s: Skipping symbolic link \"%s\": target is not a regular file\n", op, localPath)
+			return false
+		}
+	} else if !fi.Mode().IsRegular() {
+		g.log.Verbosef(1, "%s: Skipping \"%s\": not a regular file\n", op, localPath)
+		return false
+	}
+	return true
+}
+
+// VerifyModifiedDate compares the modification date of the object pointed
+// by 'drivePath' (fetched fresh from Google Drive) with 'expected'. Both dates
+// are truncated to the second before comparison, matching the precision used
+// by SetModifiedDate. Returns true if the dates match and the difference
+// between the stored and expected dates.
+func (g *Gdrive) VerifyModifiedDate(drivePath string, expected time.Time) (bool, time.Duration, error) {
+	driveFile, err := g.Stat(drivePath)
+	if err != nil {
+		return false, 0, err
+	}
+	driveFile, err = g.GdriveFilesGet(driveFile.Id)
+	if err != nil {
+		return false, 0, err
+	}
+	stored, err := ModifiedDate(driveFile)
+	if err != nil {
+		return false, 0, fmt.Errorf("VerifyModifiedDate: Invalid modification date for \"%s\": %w", drivePath, err)
+	}
+	delta := stored.Sub(expected.Truncate(time.Second))
+	return delta == 0, delta, nil
+}
+
+// WalkFunc is the type of the function called by Walk for each file or
+// directory visited. See Walk for details.
+type WalkFunc func(drivePath string, driveFile *drive.File, err error) error
+
+// Walk walks the Google Drive tree rooted at 'root', calling 'fn' for each
+// file or directory in the tree, including root. This works in the same way
+// as filepath.Walk: files in each directory are visited in lexical order, the
+// paths passed to fn are full paths (always starting with "/"), and returning
+// filepath.SkipDir from fn when invoked on a directory skips the contents of
+// that directory. Any other non-nil error returned by fn stops the walk.
+//
+// Every object visited is added to the cache, so a Stat on any path returned
+// by Walk is cheap.
+func (g *Gdrive) Walk(root string, fn WalkFunc) error {
+	_, _, root = splitPath(root)
+	root = path.Join("/", root)
+
+	driveFile, err := g.Stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = g.walk(root, driveFile, fn)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+// WalkEntries walks the Google Drive tree rooted at 'root' (see Walk) and
+// returns a PathEntry for each file or directory in the tree, including root,
+// in the order visited.
+func (g *Gdrive) WalkEntries(root string) ([]PathEntry, error) {
+	var ret []PathEntry
+
+	err := g.Walk(root, func(p string, driveFile *drive.File, err error) error {
+		if err != nil {
+			return err
+		}
+		ret = append(ret, PathEntry{Path: p, File: driveFile})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// walk recursively descends 'drivePath', calling fn. This is a helper for Walk.
+func (g *Gdrive) walk(drivePath string, driveFile *drive.File, fn WalkFunc) error {
+	if !IsDir(driveFile) {
+		return fn(drivePath, driveFile, nil)
+	}
+
+	children, files, err := g.readDir(driveFile.Id)
+	err1 := fn(drivePath, driveFile, err)
+	if err != nil || err1 != nil {
+		return err1
+	}
+
+	for idx, child := range files {
+		childPath := path.Join("/", drivePath, child.Title)
+		_, _, key := splitPath(childPath)
+		cacheAdd(g.filecache, key, child)
+		if IsDir(child) {
+			cacheAdd(g.childcache, strings.TrimPrefix(key, "/"), children[idx])
+		}
+		err = g.walk(childPath, child, fn)
+		if err != nil {
+			if !IsDir(child) || err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readDir returns the (non-trashed) children of the directory with id
+// 'parentID' along with their metadata, sorted by title. All children are
+// fetched with a single (paged) Files.List. This is a helper for walk.
+func (g *Gdrive) readDir(parentID string) ([]*drive.ChildReference, []*drive.File, error) {
+	var (
+		children []*drive.ChildReference
+		files    []*drive.File
+	)
+
+	// Directories "created" in dry run mode have no ID and are empty.
+	if parentID == "" {
+		return nil, nil, nil
+	}
+	query := fmt.Sprintf("'%s' in parents and trashed = false", parentID)
+	err := g.GdriveFilesListFunc(query, "", func(driveFile *drive.File) error {
+		children = append(children, &drive.ChildReference{Id: driveFile.Id})
+		files = append(files, driveFile)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Sort(byTitle{children, files})
+	return children, files, nil
+}
+
+// WriteFile inserts a file named 'drivePath' with 'data' as its contents,
+// like ioutil.WriteFile. An existing file is replaced, as with Insert.
+//
+// Returns *drive.File pointing to the file in its final location.
+func (g *Gdrive) WriteFile(drivePath string, data []byte) (*drive.File, error) {
+	return g.Insert(drivePath, bytes.NewReader(data))
+}
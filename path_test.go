@@ -0,0 +1,150 @@
+package godrive
+
+// Tests for path.go
+//
+// This file is part of the godrive library
+//
+// (C) 2015 by Marco Paganini <paganini@paganini.net>
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/drive/v2"
+)
+
+func TestExists(t *testing.T) {
+	g, fd := newTestGdrive(t)
+	dir := fd.add("root", "dir", true)
+	fd.add(dir.Id, "present", false)
+	fd.add(dir.Id, "dup", false)
+	fd.add(dir.Id, "dup", false)
+
+	casetests := []struct {
+		drivePath string
+		want      bool
+		wantErr   bool
+	}{
+		{"/dir/present", true, false},
+		{"/dir", true, false},
+		{"/dir/missing", false, false},
+		{"/missing/present", false, false},
+		{"/dir/dup", false, true},
+	}
+
+	for _, tt := range casetests {
+		got, err := g.Exists(tt.drivePath)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Exists(%q): got error %v, want error: %v", tt.drivePath, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("Exists(%q) = %v, want %v", tt.drivePath, got, tt.want)
+		}
+	}
+}
+
+func TestDownloadExpiredURL(t *testing.T) {
+	g, fd := newTestGdrive(t)
+	driveFile := fd.add("root", "file", false)
+	fd.setDownload(driveFile, "expired", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "expired", http.StatusUnauthorized)
+	})
+
+	// Cache the object holding the expired URL, then refresh it on the server.
+	if _, err := g.Stat("/file"); err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	fd.setDownload(driveFile, "fresh", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("contents"))
+	})
+
+	reader, err := g.Download("/file")
+	if err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Download: Error reading contents: %v", err)
+	}
+	if string(data) != "contents" {
+		t.Errorf("Download: got %q, want %q", data, "contents")
+	}
+}
+
+func TestInsertTmpIsFile(t *testing.T) {
+	g, fd := newTestGdrive(t)
+	fd.add("root", "tmp", false)
+
+	_, err := g.Insert("/file", strings.NewReader("contents"))
+	if err == nil {
+		t.Fatalf("Insert: got no error with a file named \"tmp\" in the root directory")
+	}
+	if !strings.Contains(err.Error(), "is a file, not a directory") {
+		t.Errorf("Insert: got error %q, want an error explaining that \"tmp\" is a file", err)
+	}
+}
+
+func TestMkdirAllDryRun(t *testing.T) {
+	g, _ := newTestGdrive(t)
+	g.SetDryRun(true)
+
+	driveFile, err := g.MkdirAll("a/b/c")
+	if err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if !IsDir(driveFile) || driveFile.Title != "c" {
+		t.Errorf("MkdirAll: got %+v, want a directory named \"c\"", driveFile)
+	}
+}
+
+func TestStatAfterWalk(t *testing.T) {
+	g, fd := newTestGdrive(t)
+	dir := fd.add("root", "dir", true)
+	sub := fd.add(dir.Id, "sub", true)
+	fd.add(sub.Id, "file", false)
+
+	var paths []string
+	err := g.Walk("/dir", func(drivePath string, driveFile *drive.File, err error) error {
+		paths = append(paths, drivePath)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+
+	before := fd.requestCount()
+	for _, p := range paths {
+		if _, err := g.Stat(p); err != nil {
+			t.Errorf("Stat(%q): %v", p, err)
+		}
+	}
+	if n := fd.requestCount() - before; n != 0 {
+		t.Errorf("Stat after Walk: got %d requests, want 0", n)
+	}
+}
+
+func TestSyncDirKeepsSkippedFiles(t *testing.T) {
+	g, fd := newTestGdrive(t)
+	g.SetFollowSymlinks(false)
+	dir := fd.add("root", "dst", true)
+	fd.add(dir.Id, "link", false)
+
+	localDir := t.TempDir()
+	if err := os.Symlink("/nonexistent", filepath.Join(localDir, "link")); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+
+	// fakeDrive does not implement Files.Trash, so any removal fails.
+	summary, err := g.SyncDir(localDir, "/dst", true)
+	if err != nil {
+		t.Fatalf("SyncDir: %v", err)
+	}
+	if summary.Deleted != 0 {
+		t.Errorf("SyncDir: got %d deleted objects, want 0", summary.Deleted)
+	}
+}
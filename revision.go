@@ -0,0 +1,66 @@
+package godrive
+
+// Revision related functions for godrive
+//
+// This file is part of the godrive library
+//
+// (C) 2015 by Marco Paganini <paganini@paganini.net>
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	drive "google.golang.org/api/drive/v2"
+)
+
+// DownloadRevision returns an io.ReadCloser to the contents of revision
+// 'revisionID' of the file pointed by 'drivePath'. The caller is responsible
+// for closing it. Revisions of native Google documents cannot be downloaded
+// directly.
+func (g *Gdrive) DownloadRevision(drivePath string, revisionID string) (io.ReadCloser, error) {
+	driveFile, err := g.Stat(drivePath)
+	if err != nil {
+		return nil, err
+	}
+	rev, err := g.GdriveRevisionsGet(driveFile.Id, revisionID)
+	if err != nil {
+		return nil, fmt.Errorf("DownloadRevision: Error retrieving revision \"%s\" of \"%s\": %w", revisionID, drivePath, err)
+	}
+	if rev.DownloadUrl == "" {
+		return nil, fmt.Errorf("DownloadRevision: Revision \"%s\" of \"%s\" is not downloadable", revisionID, drivePath)
+	}
+	reader, err := g.fetchURL(context.Background(), rev.DownloadUrl)
+	if err != nil {
+		return nil, fmt.Errorf("DownloadRevision: Error downloading revision \"%s\" of \"%s\": %w", revisionID, drivePath, err)
+	}
+	return reader, nil
+}
+
+// ListRevisions returns a slice of *drive.Revision with all revisions of the
+// object pointed by 'drivePath', oldest first.
+func (g *Gdrive) ListRevisions(drivePath string) ([]*drive.Revision, error) {
+	driveFile, err := g.Stat(drivePath)
+	if err != nil {
+		return nil, err
+	}
+	revs, err := g.GdriveRevisionsList(driveFile.Id)
+	if err != nil {
+		return nil, fmt.Errorf("ListRevisions: Error listing revisions of \"%s\": %w", drivePath, err)
+	}
+	return revs, nil
+}
+
+// PinRevision marks revision 'revisionID' of the file pointed by 'drivePath'
+// to be kept forever, preventing Google Drive from purging it automatically.
+func (g *Gdrive) PinRevision(drivePath string, revisionID string) error {
+	driveFile, err := g.Stat(drivePath)
+	if err != nil {
+		return err
+	}
+	_, err = g.GdriveRevisionsPatch(driveFile.Id, revisionID, &drive.Revision{Pinned: true})
+	if err != nil {
+		return fmt.Errorf("PinRevision: Error pinning revision \"%s\" of \"%s\": %w", revisionID, drivePath, err)
+	}
+	return nil
+}
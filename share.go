@@ -0,0 +1,134 @@
+package godrive
+
+// Sharing and permission related functions for godrive
+//
+// This file is part of the godrive library
+//
+// (C) 2015 by Marco Paganini <paganini@paganini.net>
+
+import (
+	"fmt"
+
+	drive "google.golang.org/api/drive/v2"
+)
+
+// ListSharedWith returns a slice of *drive.File objects (not trashed) that
+// can be read or written by the user with the given email address. Files
+// shared with a group or domain containing that user are not returned.
+func (g *Gdrive) ListSharedWith(email string) ([]*drive.File, error) {
+	if email == "" {
+		return nil, fmt.Errorf("ListSharedWith: empty email address")
+	}
+	e := escapeQuotes(email)
+	query := fmt.Sprintf("('%s' in readers or '%s' in writers) and trashed = false", e, e)
+	return g.GdriveFilesList(query, "")
+}
+
+// ListPermissions returns a slice of *drive.Permission with all permissions
+// set on the object pointed by 'drivePath'. The Role and EmailAddress fields
+// of each permission describe who has access and how.
+func (g *Gdrive) ListPermissions(drivePath string) ([]*drive.Permission, error) {
+	driveFile, err := g.Stat(drivePath)
+	if err != nil {
+		return nil, err
+	}
+	perms, err := g.GdrivePermissionsList(driveFile.Id)
+	if err != nil {
+		return nil, fmt.Errorf("ListPermissions: Error listing permissions for \"%s\": %w", drivePath, err)
+	}
+	return perms, nil
+}
+
+// MakePublic makes the object pointed by 'drivePath' readable by anyone who
+// has the link. Returns a link that can be used to download the file, or to
+// view it in the browser if no direct download is possible (native Google
+// Docs and directories.)
+func (g *Gdrive) MakePublic(drivePath string) (string, error) {
+	driveFile, err := g.Stat(drivePath)
+	if err != nil {
+		return "", err
+	}
+
+	perm := &drive.Permission{Type: "anyone", Role: "reader"}
+	if _, err = g.GdrivePermissionsInsert(driveFile.Id, perm); err != nil {
+		return "", fmt.Errorf("MakePublic: Error sharing \"%s\" (sharing may be restricted by domain policy): %w", drivePath, err)
+	}
+
+	// Links are only populated once the object is shared.
+	driveFile, err = g.GdriveFilesGet(driveFile.Id)
+	if err != nil {
+		return "", err
+	}
+	cacheAdd(g.filecache, drivePath, driveFile)
+	if driveFile.WebContentLink != "" {
+		return driveFile.WebContentLink, nil
+	}
+	return driveFile.AlternateLink, nil
+}
+
+// Share grants the user with the given email address access to the object
+// pointed by 'drivePath'. The role must be one of "reader", "writer" or
+// "owner". Errors from Google Drive (e.g., sharing disabled by domain policy)
+// are returned to the caller.
+//
+// Returns the *drive.Permission just created.
+func (g *Gdrive) Share(drivePath string, email string, role string) (*drive.Permission, error) {
+	if email == "" {
+		return nil, fmt.Errorf("Share: empty email address")
+	}
+	switch role {
+	case "reader", "writer", "owner":
+	default:
+		return nil, fmt.Errorf("Share: Invalid role \"%s\" (must be reader, writer or owner)", role)
+	}
+
+	driveFile, err := g.Stat(drivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	perm := &drive.Permission{Type: "user", Role: role, Value: email}
+	ret, err := g.GdrivePermissionsInsert(driveFile.Id, perm)
+	if err != nil {
+		return nil, fmt.Errorf("Share: Error sharing \"%s\" with %s (sharing may be restricted by domain policy): %w", drivePath, email, err)
+	}
+	return ret, nil
+}
+
+// SetWritersCanShare controls whether users with write access to the object
+// pointed by 'drivePath' can change its sharing settings. Setting 'allow' to
+// false restricts sharing changes to the owner.
+//
+// Returns *drive.File pointing to the modified file/dir.
+func (g *Gdrive) SetWritersCanShare(drivePath string, allow bool) (*drive.File, error) {
+	driveFile, err := g.Stat(drivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	patch := &drive.File{
+		WritersCanShare: allow,
+		ForceSendFields: []string{"WritersCanShare"},
+	}
+	driveFile, err = g.gdriveFilesPatch(driveFile.Id, patch, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("SetWritersCanShare: Error patching \"%s\": %w", drivePath, err)
+	}
+	cacheAdd(g.filecache, drivePath, driveFile)
+	return driveFile, nil
+}
+
+// Unshare removes the permission identified by 'permissionID' (as returned by
+// ListPermissions or Share) from the object pointed by 'drivePath', revoking
+// access.
+func (g *Gdrive) Unshare(drivePath string, permissionID string) error {
+	driveFile, err := g.Stat(drivePath)
+	if err != nil {
+		return err
+	}
+	err = g.GdrivePermissionsDelete(driveFile.Id, permissionID)
+	if err != nil {
+		return fmt.Errorf("Unshare: Error removing permission \"%s\" from \"%s\": %w", permissionID, drivePath, err)
+	}
+	return nil
+}
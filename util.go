@@ -7,18 +7,105 @@ package godrive
 // (C) 2015 by Marco Paganini <paganini@paganini.net>
 
 import (
+	"context"
+	"crypto/md5"
+	crand "crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
-	drive "code.google.com/p/google-api-go-client/drive/v2"
-	"code.google.com/p/google-api-go-client/googleapi"
+	drive "google.golang.org/api/drive/v2"
+	"google.golang.org/api/googleapi"
 )
 
+// byTitle sorts a slice of *drive.File by title, keeping a parallel slice of
+// *drive.ChildReference in the same order.
+type byTitle struct {
+	children []*drive.ChildReference
+	files    []*drive.File
+}
+
+func (b byTitle) Len() int           { return len(b.files) }
+func (b byTitle) Less(i, j int) bool { return b.files[i].Title < b.files[j].Title }
+func (b byTitle) Swap(i, j int) {
+	b.children[i], b.children[j] = b.children[j], b.children[i]
+	b.files[i], b.files[j] = b.files[j], b.files[i]
+}
+
+// progressReader wraps an io.Reader, calling 'cb' with the cumulative number
+// of bytes read after each successful Read.
+type progressReader struct {
+	reader io.Reader
+	total  int64
+	cb     func(int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.reader.Read(b)
+	if n > 0 {
+		p.total += int64(n)
+		if p.cb != nil {
+			p.cb(p.total)
+		}
+	}
+	return n, err
+}
+
+// CanDownload returns true if the contents of the passed *drive.File object
+// can be downloaded directly. Native Google Docs (and directories) cannot be
+// downloaded and must be exported to another format instead.
+func CanDownload(driveFile *drive.File) bool {
+	return driveFile.DownloadUrl != ""
+}
+
 // CreateDate returns the time.Time representation of the *drive.File object's creation date.
 func CreateDate(driveFile *drive.File) (time.Time, error) {
 	return time.Parse(time.RFC3339Nano, driveFile.CreatedDate)
 }
 
+// DiffSnapshots compares two directory snapshots (as returned by Snapshot) and
+// returns the sorted titles of objects added, removed and changed between
+// 'oldSnap' and 'newSnap'. An object is considered changed if its Id or
+// modification date differs between the snapshots.
+func DiffSnapshots(oldSnap, newSnap map[string]*drive.File) (added, removed, changed []string) {
+	for title, newFile := range newSnap {
+		oldFile, ok := oldSnap[title]
+		if !ok {
+			added = append(added, title)
+			continue
+		}
+		if oldFile.Id != newFile.Id || oldFile.ModifiedDate != newFile.ModifiedDate {
+			changed = append(changed, title)
+		}
+	}
+	for title := range oldSnap {
+		if _, ok := newSnap[title]; !ok {
+			removed = append(removed, title)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return added, removed, changed
+}
+
+// FileInfo returns an os.FileInfo describing the passed *drive.File object.
+// Name returns the title, Size the file size (zero for native Google Docs),
+// ModTime the modification date and Sys the original *drive.File. The mode is
+// read-only unless the file is editable by the user.
+func FileInfo(driveFile *drive.File) os.FileInfo {
+	return &fileInfo{driveFile}
+}
+
 // IsDir returns true if the passed *drive.File object is a directory.
 func IsDir(driveFile *drive.File) bool {
 	return (driveFile.MimeType == mimeTypeFolder)
@@ -35,6 +122,142 @@ func ModifiedDate(driveFile *drive.File) (time.Time, error) {
 	return tt.Truncate(time.Second), nil
 }
 
+// md5File returns the MD5 checksum of the local file 'localFile', as a
+// lowercase hex string (the same format used by Google Drive.)
+func md5File(localFile string) (string, error) {
+	f, err := os.Open(localFile)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// newestFile returns the object with the most recent modification date in
+// 'files', which must not be empty.
+func newestFile(files []*drive.File) (*drive.File, error) {
+	var (
+		newest     *drive.File
+		newestDate time.Time
+	)
+	for _, driveFile := range files {
+		mtime, err := ModifiedDate(driveFile)
+		if err != nil {
+			return nil, err
+		}
+		if newest == nil || mtime.After(newestDate) {
+			newest = driveFile
+			newestDate = mtime
+		}
+	}
+	return newest, nil
+}
+
+// oldestFile returns the object created first in 'files', using the ID to
+// break ties, or nil if 'files' is empty. Objects with invalid creation dates
+// are ignored.
+func oldestFile(files []*drive.File) *drive.File {
+	var (
+		oldest     *drive.File
+		oldestDate time.Time
+	)
+	for _, driveFile := range files {
+		ctime, err := CreateDate(driveFile)
+		if err != nil {
+			continue
+		}
+		if oldest == nil || ctime.Before(oldestDate) || (ctime.Equal(oldestDate) && driveFile.Id < oldest.Id) {
+			oldest = driveFile
+			oldestDate = ctime
+		}
+	}
+	return oldest
+}
+
+// notDownloadable returns an error explaining why the object 'driveFile'
+// (pointed by 'drivePath') cannot be downloaded, listing the formats it can
+// be exported to, if any. 'op' is used as the prefix of the error message.
+func notDownloadable(op string, drivePath string, driveFile *drive.File) error {
+	if len(driveFile.ExportLinks) == 0 {
+		return fmt.Errorf("%s: File \"%s\" is not downloadable (no body?)", op, drivePath)
+	}
+	return fmt.Errorf("%s: File \"%s\" is a native Google document and cannot be downloaded directly. Use Export with one of: %s", op, drivePath, exportFormats(driveFile))
+}
+
+// exportError returns an error indicating that 'driveFile' (pointed by
+// 'drivePath') cannot be exported as 'mimeType', listing the available
+// formats.
+func exportError(drivePath string, mimeType string, driveFile *drive.File) error {
+	if len(driveFile.ExportLinks) == 0 {
+		return fmt.Errorf("Export: File \"%s\" cannot be exported (not a native Google document?)", drivePath)
+	}
+	return fmt.Errorf("Export: File \"%s\" cannot be exported as \"%s\". Available formats: %s", drivePath, mimeType, exportFormats(driveFile))
+}
+
+// exportFormats returns a sorted, comma separated list of the MIME types
+// the passed *drive.File object can be exported to.
+func exportFormats(driveFile *drive.File) string {
+	var formats []string
+	for mimeType := range driveFile.ExportLinks {
+		formats = append(formats, mimeType)
+	}
+	sort.Strings(formats)
+	return strings.Join(formats, ", ")
+}
+
+// driveProperties converts a map of key/value pairs into a slice of private
+// *drive.Property objects, sorted by key. Returns nil for an empty map.
+func driveProperties(props map[string]string) []*drive.Property {
+	if len(props) == 0 {
+		return nil
+	}
+	ret := make([]*drive.Property, 0, len(props))
+	for key, value := range props {
+		ret = append(ret, &drive.Property{Key: key, Value: value, Visibility: "PRIVATE"})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Key < ret[j].Key })
+	return ret
+}
+
+// detectMimeType returns the MIME type of the local file 'file' (without
+// parameters), based on its extension or, if unknown, on its first 512 bytes.
+// The file offset is rewound to the beginning of the file.
+func detectMimeType(file *os.File) (string, error) {
+	mimeType := mime.TypeByExtension(filepath.Ext(file.Name()))
+	if mimeType == "" {
+		buf := make([]byte, 512)
+		n, err := io.ReadFull(file, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return "", err
+		}
+		if _, err = file.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		mimeType = http.DetectContentType(buf[:n])
+	}
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return "", err
+	}
+	return mediaType, nil
+}
+
+// driveDate returns 't' formatted as expected by Google Drive, rounded down
+// to the second.
+func driveDate(t time.Time) string {
+	// For some reason Gdrive requires the date to contain the nano information
+	// and Format will return a date without nano information if it happens to
+	// be zero. Add 1ns to make sure format will produce a date in the right format.
+	t = t.Truncate(1 * time.Second)
+	t = t.Add(1 * time.Nanosecond)
+	return t.Format(time.RFC3339Nano)
+}
+
 // escapeQuotes escapes single quotes inside string with a backslash. Returns the string
 // with quotes escaped.
 func escapeQuotes(str string) string {
@@ -52,58 +275,237 @@ func escapeQuotes(str string) string {
 	return strings.Join(ret, "")
 }
 
-// Execute a Gdrive Do() operation returning a *drive.ChildList and error from the
-// original operation. Retry operation (with exponential fallback) if a 5xx
-// is received from the other side.
-func driveChildListOpRetry(fn func() (*drive.ChildList, error)) (*drive.ChildList, error) {
+// tmpName returns a unique name for temporary files in the temporary folder,
+// based on 128 random bits from crypto/rand (which needs no seeding), so
+// concurrent uploads from different processes never collide.
+func tmpName() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := crand.Read(buf); err != nil {
+		return "", err
+	}
+	return "temp-" + hex.EncodeToString(buf), nil
+}
+
+// Execute a Gdrive operation wrapped in 'fn' and return its error. Retry
+// operation (with exponential backoff and jitter) if a 5xx or a 403 rate limit
+// error is received from the other side, or if the retry predicate set with
+// SetRetryPredicate says so, up to the maximum number of tries set with
+// SetRetryPolicy. Every attempt waits for the rate limiter set with
+// SetRateLimit, if any. If the OAuth token is rejected, it is refreshed and
+// the operation retried once. The context is checked before every attempt and
+// while waiting between attempts; ctx.Err() is returned if it's done.
+func (g *Gdrive) driveOpRetry(ctx context.Context, fn func() error) error {
+	return g.driveOpTries(ctx, g.maxTries, fn)
+}
+
+// driveOpTries works like driveOpRetry, trying the operation at most 'tries'
+// times. With a single try, 'fn' is called exactly once (not even after a
+// token refresh), which is needed for operations that cannot be repeated.
+func (g *Gdrive) driveOpTries(ctx context.Context, tries int, fn func() error) error {
 	var (
-		err            error
-		driveChildList *drive.ChildList
+		err       error
+		refreshed bool
 	)
-	for try := 1; try <= numTries; try++ {
-		driveChildList, err = fn()
-		if err != nil {
-			// HTTP error?
-			if derr, ok := err.(*googleapi.Error); ok {
-				// 5xx?
-				if derr.Code >= 500 || derr.Code <= 599 {
-					//time.Sleep(time.Millisecond * (rand.Int31n(2000) + 1000*try))
-					time.Sleep(time.Millisecond * time.Duration(1000*try))
-					continue
+
+	for try := 1; try <= tries; try++ {
+		if cerr := ctx.Err(); cerr != nil {
+			return cerr
+		}
+		if g.limiter != nil {
+			if lerr := g.limiter.Wait(ctx); lerr != nil {
+				return lerr
+			}
+		}
+		err = fn()
+		// Refresh the token and try again (once) if it was rejected.
+		if err != nil && tries > 1 && !refreshed && isUnauthorized(err) && g.transport != nil {
+			refreshed = true
+			if g.RefreshToken() == nil {
+				err = fn()
+			}
+		}
+		if err == nil {
+			return nil
+		}
+		if try == tries || !g.shouldRetry(err, try) {
+			return newAPIError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff(g.retryBase, try)):
+		}
+	}
+	return newAPIError(err)
+}
+
+// backoff returns the delay before retrying after attempt number 'try'
+// (starting at 1): base*2^(try-1) plus a random jitter of up to 'base'.
+func backoff(base time.Duration, try int) time.Duration {
+	return base<<uint(try-1) + time.Duration(rand.Int63n(int64(base)))
+}
+
+// shouldRetry returns true if the operation that failed with 'err' on attempt
+// number 'try' should be retried. The retry predicate is used if set;
+// otherwise 5xx errors and 403 rate limit errors are retried.
+func (g *Gdrive) shouldRetry(err error, try int) bool {
+	if g.retryPredicate != nil {
+		return g.retryPredicate(newAPIError(err), try)
+	}
+	// HTTP error?
+	var derr *googleapi.Error
+	if errors.As(err, &derr) {
+		// 5xx?
+		if derr.Code >= 500 && derr.Code <= 599 {
+			return true
+		}
+		// 403 due to rate limiting?
+		if derr.Code == 403 {
+			for _, item := range derr.Errors {
+				switch item.Reason {
+				case "rateLimitExceeded", "userRateLimitExceeded", "backendError":
+					return true
 				}
 			}
-			return nil, err
 		}
-		return driveChildList, err
 	}
-	return nil, err
+	return false
+}
+
+// measure returns 'fn' wrapped to report its duration and outcome to the
+// metrics hook as 'op'. If no hook is set, 'fn' is returned unchanged.
+func (g *Gdrive) measure(op string, fn func() error) func() error {
+	hook := g.metricsHook
+	if hook == nil {
+		return fn
+	}
+	return func() error {
+		start := time.Now()
+		err := fn()
+		hook(op, time.Since(start), err)
+		return err
+	}
+}
+
+// Execute a Gdrive Do() operation returning a *drive.ChildList and error from the
+// original operation. Retry operation (with exponential fallback) if a 5xx
+// or a 403 rate limit error is received from the other side. Each attempt is
+// reported to the metrics hook as 'op'.
+func (g *Gdrive) driveChildListOpRetry(ctx context.Context, op string, fn func() (*drive.ChildList, error)) (*drive.ChildList, error) {
+	var driveChildList *drive.ChildList
+
+	err := g.driveOpRetry(ctx, g.measure(op, func() error {
+		var err error
+		driveChildList, err = fn()
+		return err
+	}))
+	if err != nil {
+		return nil, err
+	}
+	return driveChildList, nil
 }
 
 // Execute a Gdrive Do() operation returning a *drive.File and error from the
 // original operation. Retry operation (with exponential fallback) if a 5xx
-// is received from the other side.
-func driveFileOpRetry(fn func() (*drive.File, error)) (*drive.File, error) {
-	var (
-		err       error
-		driveFile *drive.File
-	)
-	for try := 1; try <= numTries; try++ {
+// or a 403 rate limit error is received from the other side. Each attempt is
+// reported to the metrics hook as 'op'.
+func (g *Gdrive) driveFileOpRetry(ctx context.Context, op string, fn func() (*drive.File, error)) (*drive.File, error) {
+	var driveFile *drive.File
+
+	err := g.driveOpRetry(ctx, g.measure(op, func() error {
+		var err error
 		driveFile, err = fn()
-		if err != nil {
-			// HTTP error?
-			if derr, ok := err.(*googleapi.Error); ok {
-				// 5xx?
-				if derr.Code >= 500 || derr.Code <= 599 {
-					//time.Sleep(time.Millisecond * (rand.Int31n(2000) + 1000*try))
-					time.Sleep(time.Millisecond * time.Duration(1000*try))
-					continue
+		return err
+	}))
+	if err != nil {
+		return nil, err
+	}
+	return driveFile, nil
+}
+
+// Execute a Gdrive upload operation returning a *drive.File and error from the
+// original operation. 'fn' must build and run a new request sending the
+// contents of 'reader' on every call. Every attempt reads 'reader' from the
+// start: it is rewound to its initial position if it implements io.Seeker.
+// Other readers cannot be sent again, so the operation is tried only once. A
+// nil reader (no contents) is retried as with driveFileOpRetry.
+func (g *Gdrive) driveMediaOpRetry(ctx context.Context, op string, reader io.Reader, fn func(reader io.Reader) (*drive.File, error)) (*drive.File, error) {
+	var driveFile *drive.File
+
+	tries := g.maxTries
+	attempt := func() error {
+		var err error
+		driveFile, err = fn(reader)
+		return err
+	}
+	if reader != nil {
+		seeker, ok := reader.(io.Seeker)
+		if !ok {
+			tries = 1
+		} else {
+			start, err := seeker.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return nil, err
+			}
+			send := attempt
+			attempt = func() error {
+				if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+					return err
 				}
+				return send()
 			}
-			return nil, err
 		}
-		return driveFile, err
 	}
-	return nil, err
+
+	err := g.driveOpTries(ctx, tries, g.measure(op, attempt))
+	if err != nil {
+		return nil, err
+	}
+	return driveFile, nil
+}
+
+// Execute a Gdrive Do() operation returning a *drive.FileList and error from the
+// original operation. Retry operation (with exponential fallback) if a 5xx
+// or a 403 rate limit error is received from the other side. Each attempt is
+// reported to the metrics hook as 'op'.
+func (g *Gdrive) driveFileListOpRetry(ctx context.Context, op string, fn func() (*drive.FileList, error)) (*drive.FileList, error) {
+	var driveFileList *drive.FileList
+
+	err := g.driveOpRetry(ctx, g.measure(op, func() error {
+		var err error
+		driveFileList, err = fn()
+		return err
+	}))
+	if err != nil {
+		return nil, err
+	}
+	return driveFileList, nil
+}
+
+// isAuthError returns true if 'err' is an HTTP 401 or 403 returned by Google
+// Drive.
+func isAuthError(err error) bool {
+	var derr *googleapi.Error
+	if errors.As(err, &derr) {
+		return derr.Code == 401 || derr.Code == 403
+	}
+	return false
+}
+
+// isUnauthorized returns true if 'err' is an HTTP 401 returned by Google
+// Drive.
+func isUnauthorized(err error) bool {
+	var derr *googleapi.Error
+	if errors.As(err, &derr) {
+		return derr.Code == 401
+	}
+	return false
+}
+
+// hasMeta returns true if 'str' contains any of the special characters
+// recognized by path.Match.
+func hasMeta(str string) bool {
+	return strings.ContainsAny(str, `*?[\`)
 }
 
 // splitPath takes a Unix like pathname, splits it on its components, and
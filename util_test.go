@@ -0,0 +1,89 @@
+package godrive
+
+// Tests for util.go
+//
+// This file is part of the godrive library
+//
+// (C) 2015 by Marco Paganini <paganini@paganini.net>
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// apiErr returns a *googleapi.Error with the given HTTP code and reason.
+func apiErr(code int, reason string) error {
+	derr := &googleapi.Error{Code: code}
+	if reason != "" {
+		derr.Errors = []googleapi.ErrorItem{{Reason: reason}}
+	}
+	return derr
+}
+
+func TestShouldRetry(t *testing.T) {
+	casetests := []struct {
+		err  error
+		want bool
+	}{
+		{apiErr(500, ""), true},
+		{apiErr(503, "backendError"), true},
+		{apiErr(599, ""), true},
+		{apiErr(403, "rateLimitExceeded"), true},
+		{apiErr(403, "userRateLimitExceeded"), true},
+		{apiErr(403, "backendError"), true},
+		{apiErr(403, "insufficientPermissions"), false},
+		{apiErr(403, ""), false},
+		{apiErr(404, "notFound"), false},
+		{apiErr(400, ""), false},
+		{apiErr(600, ""), false},
+		{errors.New("not an API error"), false},
+	}
+
+	g := newGdrive(Options{})
+	for _, tt := range casetests {
+		if got := g.shouldRetry(tt.err, 1); got != tt.want {
+			t.Errorf("shouldRetry(%+v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestDriveOpRetryPermissionDenied(t *testing.T) {
+	// Any wait between attempts would exceed the context deadline.
+	g := newGdrive(Options{})
+	g.SetRetryPolicy(3, time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	calls := 0
+	err := g.driveOpRetry(ctx, func() error {
+		calls++
+		return apiErr(403, "insufficientPermissions")
+	})
+	if calls != 1 {
+		t.Errorf("driveOpRetry: got %d calls, want 1", calls)
+	}
+	if !IsPermissionDenied(err) {
+		t.Errorf("driveOpRetry: got error %v, want a permission denied *APIError", err)
+	}
+}
+
+func TestDriveOpRetryRateLimited(t *testing.T) {
+	g := newGdrive(Options{})
+	g.SetRetryPolicy(3, time.Nanosecond)
+
+	calls := 0
+	err := g.driveOpRetry(context.Background(), func() error {
+		calls++
+		return apiErr(403, "rateLimitExceeded")
+	})
+	if calls != 3 {
+		t.Errorf("driveOpRetry: got %d calls, want 3", calls)
+	}
+	if !IsRateLimited(err) {
+		t.Errorf("driveOpRetry: got error %v, want a rate limited *APIError", err)
+	}
+}